@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	notes  []string
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps SSE (live reload) working through the logger.
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// addLogNote appends key=value style detail to the request's access log
+// line. It does nothing when -access-log is off.
+func addLogNote(w http.ResponseWriter, note string) {
+	for w != nil {
+		if lw, ok := w.(*loggingResponseWriter); ok {
+			lw.notes = append(lw.notes, note)
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+
+		user := requestIdentity(r)
+		if user == "" {
+			user = "-"
+		}
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		line := fmt.Sprintf("%s %s %q %d %d %s", r.RemoteAddr, user, r.Method+" "+r.URL.RequestURI(),
+			status, lw.bytes, time.Since(start).Round(time.Millisecond))
+		if len(lw.notes) > 0 {
+			line += " " + strings.Join(lw.notes, " ")
+		}
+		log.Print(line)
+	})
+}
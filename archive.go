@@ -0,0 +1,458 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveFormat describes one ?format= choice for /__zip.
+type archiveFormat struct {
+	ext         string
+	contentType string
+	write       func(w io.Writer, spec archiveSpec) ([]skippedEntry, error)
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"":        {".zip", "application/zip", zipArchive},
+	"zip":     {".zip", "application/zip", zipArchive},
+	"tar":     {".tar", "application/x-tar", tarArchive},
+	"tar.gz":  {".tar.gz", "application/gzip", tarGzArchive},
+	"tgz":     {".tar.gz", "application/gzip", tarGzArchive},
+	"tar.zst": {".tar.zst", "application/zstd", tarZstArchive},
+}
+
+// Symlink policies for archives (-zip-symlinks).
+const (
+	symlinkSkip   = "skip"   // leave symlinks out
+	symlinkLink   = "link"   // store the link itself
+	symlinkFollow = "follow" // archive the target if it is inside the root
+)
+
+func validSymlinkPolicy(p string) bool {
+	return p == symlinkSkip || p == symlinkLink || p == symlinkFollow
+}
+
+// defaultSymlinks is the policy for a format without -zip-symlinks: tar
+// stores links as they are, while zip has no portable symlink entry and
+// follows them.
+func defaultSymlinks(ext string) string {
+	if ext == ".zip" {
+		return symlinkFollow
+	}
+	return symlinkLink
+}
+
+// withSymlinks fills in the default policy for ext if spec has none.
+func (spec archiveSpec) withSymlinks(ext string) archiveSpec {
+	if spec.symlinks == "" {
+		spec.symlinks = defaultSymlinks(ext)
+	}
+	return spec
+}
+
+// archiveManifestName is added to an archive listing what was left out.
+const archiveManifestName = "dserve-skipped.txt"
+
+// archiveSpec is what to put in an archive and how.
+type archiveSpec struct {
+	root     string // absolute serve directory
+	sources  []archiveSource
+	filter   archiveFilter
+	level    int    // compress/flate level, see ZipConfig
+	symlinks string // symlinkSkip, symlinkLink or symlinkFollow; "" for the format's default
+	hide     *visibility
+}
+
+// archiveSource is a file or directory to archive. Its entries are stored
+// under name; an empty name puts a directory's contents at the top level.
+type archiveSource struct {
+	path string
+	name string
+}
+
+// archiveEntry is one file, directory or stored symlink handed to an
+// archive writer. path is where to read it from, which differs from the
+// walked path for followed symlinks.
+type archiveEntry struct {
+	path string
+	name string
+	info os.FileInfo
+	link string // symlink target when the link itself is stored
+}
+
+// skippedEntry records an entry left out of an archive. err is set for
+// read failures, as opposed to entries skipped by policy.
+type skippedEntry struct {
+	name   string
+	reason string
+	err    bool
+}
+
+// entrySkip is returned by an archive writer that could not read an
+// entry; the walk records it and moves on.
+type entrySkip struct {
+	reason string
+}
+
+func (e *entrySkip) Error() string { return e.reason }
+
+// archiveFilter holds include/exclude globs. Patterns match an entry's
+// base name or its slash-separated path in the archive; a trailing "/"
+// only matches directories. Directories are always descended into unless
+// excluded, so include patterns select files at any depth.
+type archiveFilter struct {
+	include []string
+	exclude []string
+}
+
+func newArchiveFilter(include, exclude []string) (archiveFilter, error) {
+	var f archiveFilter
+	for _, list := range []struct {
+		dst *[]string
+		src []string
+	}{{&f.include, include}, {&f.exclude, exclude}} {
+		for _, v := range list.src {
+			for _, p := range parseList(v) {
+				if _, err := path.Match(strings.TrimSuffix(p, "/"), ""); err != nil {
+					return archiveFilter{}, fmt.Errorf("invalid pattern %q", p)
+				}
+				*list.dst = append(*list.dst, p)
+			}
+		}
+	}
+	return f, nil
+}
+
+func matchGlob(patterns []string, name string, isDir bool) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") {
+			if !isDir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveWalker walks the sources of one archive.
+type archiveWalker struct {
+	spec     archiveSpec
+	realRoot string
+	fn       func(archiveEntry) error
+	skipped  []skippedEntry
+}
+
+// walkArchive calls fn for every file, directory and stored symlink under
+// the sources, named as it should appear in the archive. Hidden entries,
+// filtered entries and symlinks the policy rejects are left out; so are
+// entries that cannot be read, which are returned rather than failing
+// the archive. An error from fn other than *entrySkip stops the walk.
+func walkArchive(spec archiveSpec, fn func(archiveEntry) error) ([]skippedEntry, error) {
+	realRoot, err := filepath.EvalSymlinks(spec.root)
+	if err != nil {
+		return nil, err
+	}
+	wk := &archiveWalker{spec: spec, realRoot: realRoot, fn: fn}
+	for _, src := range spec.sources {
+		info, err := os.Lstat(src.path)
+		if err != nil {
+			wk.skip(src.name, "cannot read: "+errReason(err), true)
+			continue
+		}
+		rel, _ := filepath.Rel(spec.root, src.path)
+		if err := wk.walk(src.path, filepath.ToSlash(rel), src.name, info, nil); err != nil {
+			return wk.skipped, err
+		}
+	}
+	return wk.skipped, nil
+}
+
+func (wk *archiveWalker) skip(name, reason string, isErr bool) {
+	if name == "" {
+		name = "."
+	}
+	wk.skipped = append(wk.skipped, skippedEntry{name: name, reason: reason, err: isErr})
+}
+
+// walk visits fsPath, found at rel (slash-separated, relative to the
+// root) and stored as name. ancestors holds the resolved directories
+// above it, to stop symlink loops.
+func (wk *archiveWalker) walk(fsPath, rel, name string, info os.FileInfo, ancestors []string) error {
+	if wk.spec.hide.hiddenEntry(rel, info.IsDir()) {
+		return nil
+	}
+	if name != "" && matchGlob(wk.spec.filter.exclude, name, info.IsDir()) {
+		return nil
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch wk.spec.symlinks {
+		case symlinkLink:
+			target, err := os.Readlink(fsPath)
+			if err != nil {
+				wk.skip(name, "cannot read symlink: "+errReason(err), true)
+				return nil
+			}
+			return wk.emit(archiveEntry{path: fsPath, name: name, info: info, link: target})
+		case symlinkFollow:
+			real, err := filepath.EvalSymlinks(fsPath)
+			if err != nil {
+				wk.skip(name, "broken symlink", false)
+				return nil
+			}
+			if !withinDir(wk.realRoot, real) {
+				wk.skip(name, "symlink points outside the served directory", false)
+				return nil
+			}
+			if info, err = os.Stat(real); err != nil {
+				wk.skip(name, "cannot read: "+errReason(err), true)
+				return nil
+			}
+			if info.IsDir() && wk.spec.hide.hiddenEntry(rel, true) {
+				return nil
+			}
+			fsPath = real
+		default:
+			wk.skip(name, "symlink", false)
+			return nil
+		}
+	}
+
+	if info.IsDir() {
+		return wk.walkDir(fsPath, rel, name, info, ancestors)
+	}
+	if !info.Mode().IsRegular() {
+		wk.skip(name, "not a regular file", false)
+		return nil
+	}
+	if len(wk.spec.filter.include) > 0 && !matchGlob(wk.spec.filter.include, name, false) {
+		return nil
+	}
+	return wk.emit(archiveEntry{path: fsPath, name: name, info: info})
+}
+
+func (wk *archiveWalker) walkDir(fsPath, rel, name string, info os.FileInfo, ancestors []string) error {
+	real, err := filepath.EvalSymlinks(fsPath)
+	if err != nil {
+		wk.skip(name, "cannot read directory: "+errReason(err), true)
+		return nil
+	}
+	for _, a := range ancestors {
+		if a == real {
+			wk.skip(name, "symlink loop", false)
+			return nil
+		}
+	}
+
+	if name != "" {
+		if err := wk.emit(archiveEntry{path: fsPath, name: name, info: info}); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(fsPath)
+	if err != nil {
+		wk.skip(name, "cannot read directory: "+errReason(err), true)
+		return nil
+	}
+	ancestors = append(ancestors, real)
+	for _, e := range entries {
+		childName := path.Join(name, e.Name())
+		childInfo, err := e.Info()
+		if err != nil {
+			wk.skip(childName, "cannot read: "+errReason(err), true)
+			continue
+		}
+		if err := wk.walk(filepath.Join(fsPath, e.Name()), path.Join(rel, e.Name()), childName, childInfo, ancestors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wk *archiveWalker) emit(e archiveEntry) error {
+	err := wk.fn(e)
+	var skip *entrySkip
+	if errors.As(err, &skip) {
+		wk.skip(e.name, skip.reason, true)
+		return nil
+	}
+	return err
+}
+
+// withinDir reports whether p is dir or below it. Both must be clean
+// absolute paths.
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// errReason shortens an os error to its cause, dropping the path.
+func errReason(err error) string {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Err.Error()
+	}
+	return err.Error()
+}
+
+// manifest lists skipped entries, one per line.
+func manifest(skipped []skippedEntry) []byte {
+	var b strings.Builder
+	b.WriteString("These entries were left out of this archive:\n\n")
+	for _, s := range skipped {
+		fmt.Fprintf(&b, "%s: %s\n", s.name, s.reason)
+	}
+	return []byte(b.String())
+}
+
+func tarGzArchive(w io.Writer, spec archiveSpec) ([]skippedEntry, error) {
+	gz, err := gzip.NewWriterLevel(w, spec.level)
+	if err != nil {
+		return nil, err
+	}
+	skipped, err := tarArchive(gz, spec)
+	if err != nil {
+		gz.Close()
+		return skipped, err
+	}
+	return skipped, gz.Close()
+}
+
+func tarZstArchive(w io.Writer, spec archiveSpec) ([]skippedEntry, error) {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(spec.level)))
+	if err != nil {
+		return nil, err
+	}
+	skipped, err := tarArchive(zw, spec)
+	if err != nil {
+		zw.Close()
+		return skipped, err
+	}
+	return skipped, zw.Close()
+}
+
+// zstdLevel maps a flate level onto zstd's four encoder speeds. zstd has
+// no store mode, so 0 picks the fastest.
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level < 0:
+		return zstd.SpeedDefault
+	case level <= 2:
+		return zstd.SpeedFastest
+	case level <= 6:
+		return zstd.SpeedDefault
+	case level <= 8:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// tarArchive streams spec as a tar archive. Unlike zip, tar keeps Unix
+// modes, mtimes and symlinks.
+func tarArchive(w io.Writer, spec archiveSpec) ([]skippedEntry, error) {
+	spec = spec.withSymlinks(".tar")
+	tw := tar.NewWriter(w)
+
+	skipped, err := walkArchive(spec, func(e archiveEntry) error {
+		header, err := tar.FileInfoHeader(e.info, e.link)
+		if err != nil {
+			return &entrySkip{err.Error()}
+		}
+		header.Name = e.name
+		if e.info.IsDir() {
+			header.Name += "/"
+		}
+		if !e.info.Mode().IsRegular() {
+			return tw.WriteHeader(header)
+		}
+
+		// Open before writing the header so an unreadable file is left
+		// out instead of leaving a header without its data.
+		file, err := os.Open(e.path)
+		if err != nil {
+			return &entrySkip{"cannot read: " + errReason(err)}
+		}
+		defer file.Close()
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		// CopyN keeps a file that grew since the Lstat from overrunning
+		// its header; one that shrank or failed mid-read is padded so
+		// the archive stays readable, and reported as truncated.
+		src := &readTracker{r: file}
+		n, err := io.CopyN(tw, src, header.Size)
+		if err != nil && src.err == nil {
+			return err // the client went away
+		}
+		if err != nil {
+			if _, err := io.CopyN(tw, zeroReader{}, header.Size-n); err != nil {
+				return err
+			}
+			return &entrySkip{truncatedReason(src.err)}
+		}
+		return nil
+	})
+	if err != nil {
+		return skipped, err
+	}
+	if len(skipped) > 0 {
+		data := manifest(skipped)
+		header := &tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(header); err != nil {
+			return skipped, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, tw.Close()
+}
+
+func truncatedReason(err error) string {
+	if err == io.EOF {
+		return "truncated: file shrank while reading"
+	}
+	return "truncated: " + errReason(err)
+}
+
+// readTracker remembers the error its reader returned, so a failed copy
+// can be blamed on the file or on the archive's writer.
+type readTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
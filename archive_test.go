@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func readTar(t *testing.T, r io.Reader) map[string]*tar.Header {
+	t.Helper()
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		headers[h.Name] = h
+	}
+}
+
+func TestTarArchive(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("a"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	_ = os.Chtimes(filepath.Join(dir, "sub", "a.txt"), mtime, mtime)
+	hasLink := os.Symlink("sub/a.txt", filepath.Join(dir, "link")) == nil
+
+	var buf bytes.Buffer
+	if _, err := tarArchive(&buf, archiveSpec{root: dir, sources: []archiveSource{{path: dir}}}); err != nil {
+		t.Fatalf("tarArchive: %v", err)
+	}
+	headers := readTar(t, &buf)
+
+	if _, ok := headers[".env"]; ok {
+		t.Error("root dotfiles should be excluded")
+	}
+	if h, ok := headers["sub/"]; !ok || h.Typeflag != tar.TypeDir {
+		t.Error("missing directory entry sub/")
+	}
+	if h := headers["sub/a.txt"]; h == nil || !h.ModTime.Equal(mtime) {
+		t.Errorf("sub/a.txt mtime not preserved: %+v", h)
+	}
+	if runtime.GOOS != "windows" {
+		if h := headers["run.sh"]; h == nil || h.Mode&0111 == 0 {
+			t.Errorf("run.sh lost its executable bit: %+v", h)
+		}
+	}
+	if hasLink {
+		h := headers["link"]
+		if h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "sub/a.txt" {
+			t.Errorf("symlink not stored as a link: %+v", h)
+		}
+	}
+}
+
+func TestZipHandlerFormats(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil)
+
+	tests := []struct {
+		format      string
+		contentType string
+		filename    string
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{"tar", "application/x-tar", ".tar", func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{"tar.gz", "application/gzip", ".tar.gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"tgz", "application/gzip", ".tar.gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"tar.zst", "application/zstd", ".tar.zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/__zip?format="+tt.format, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			want := `attachment; filename="` + filepath.Base(dir) + tt.filename + `"`
+			if cd := rec.Header().Get("Content-Disposition"); cd != want {
+				t.Errorf("Content-Disposition = %q, want %q", cd, want)
+			}
+			r, err := tt.decompress(rec.Body)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if _, ok := readTar(t, r)["a.txt"]; !ok {
+				t.Error("archive missing a.txt")
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?format=rar", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", rec.Code)
+		}
+	})
+}
+
+// symlinkTree builds a tree with a file, links to it and to a directory
+// inside the root, a link leaving the root and a link loop.
+func symlinkTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "x.txt"), []byte("x"), 0644)
+	_ = os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("s"), 0644)
+	links := map[string]string{
+		"link-file": "a.txt",
+		"link-dir":  "sub",
+		"link-out":  filepath.Join(outside, "secret.txt"),
+		"sub/loop":  "..",
+		"broken":    "missing.txt",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	return dir
+}
+
+func tarContents(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	contents := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			contents[h.Name] = "-> " + h.Linkname
+		case tar.TypeDir:
+			contents[h.Name] = "dir"
+		default:
+			data, _ := io.ReadAll(tr)
+			contents[h.Name] = string(data)
+		}
+	}
+}
+
+func TestArchiveSymlinkPolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		want        map[string]string
+		absent      []string
+		wantSkipped []string
+	}{
+		{
+			policy:      symlinkSkip,
+			want:        map[string]string{"a.txt": "a", "sub/x.txt": "x"},
+			absent:      []string{"link-file", "link-dir/", "link-out", "sub/loop"},
+			wantSkipped: []string{"link-file: symlink", "link-dir: symlink", "link-out: symlink", "sub/loop: symlink", "broken: symlink"},
+		},
+		{
+			policy: symlinkLink,
+			want: map[string]string{
+				"link-file": "-> a.txt",
+				"link-dir":  "-> sub",
+				"sub/loop":  "-> ..",
+				"broken":    "-> missing.txt",
+			},
+			absent: []string{archiveManifestName},
+		},
+		{
+			policy: symlinkFollow,
+			want: map[string]string{
+				"link-file":      "a",
+				"link-dir/":      "dir",
+				"link-dir/x.txt": "x",
+			},
+			absent: []string{"link-out", "sub/loop/", "link-dir/loop/"},
+			wantSkipped: []string{
+				"link-out: symlink points outside the served directory",
+				"sub/loop: symlink loop",
+				"link-dir/loop: symlink loop",
+				"broken: broken symlink",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := symlinkTree(t)
+			var buf bytes.Buffer
+			spec := archiveSpec{root: dir, sources: []archiveSource{{path: dir}}, symlinks: tt.policy}
+			skipped, err := tarArchive(&buf, spec)
+			if err != nil {
+				t.Fatalf("tarArchive: %v", err)
+			}
+			contents := tarContents(t, &buf)
+
+			for name, want := range tt.want {
+				if got, ok := contents[name]; !ok || got != want {
+					t.Errorf("%s = %q (present %v), want %q", name, got, ok, want)
+				}
+			}
+			for _, name := range tt.absent {
+				if _, ok := contents[name]; ok {
+					t.Errorf("%s should not be in the archive", name)
+				}
+			}
+			if len(skipped) != len(tt.wantSkipped) {
+				t.Errorf("skipped %v, want %v", skipped, tt.wantSkipped)
+			}
+			for _, want := range tt.wantSkipped {
+				if !strings.Contains(contents[archiveManifestName], want+"\n") {
+					t.Errorf("manifest missing %q:\n%s", want, contents[archiveManifestName])
+				}
+			}
+		})
+	}
+}
+
+func TestZipArchiveStoresSymlinks(t *testing.T) {
+	dir := symlinkTree(t)
+	var buf bytes.Buffer
+	spec := archiveSpec{root: dir, sources: []archiveSource{{path: dir}}, symlinks: symlinkLink}
+	if _, err := zipArchive(&buf, spec); err != nil {
+		t.Fatalf("zipArchive: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "link-file" {
+			continue
+		}
+		if f.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("link-file mode = %v, want a symlink", f.Mode())
+		}
+		rc, _ := f.Open()
+		target, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(target) != "a.txt" {
+			t.Errorf("link-file target = %q, want a.txt", target)
+		}
+		return
+	}
+	t.Error("link-file missing from zip")
+}
+
+func TestZipHandlerSymlinkDefaults(t *testing.T) {
+	dir := symlinkTree(t)
+	handler := zipHandler(dir, &ZipConfig{Level: -1}, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?format=tar", nil))
+	if h := readTar(t, rec.Body)["link-file"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "a.txt" {
+		t.Errorf("tar should store symlinks by default, got %+v", h)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip", nil))
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name == "link-file" && f.Mode()&os.ModeSymlink != 0 {
+			t.Error("zip should follow symlinks by default")
+		}
+	}
+}
+
+func TestArchiveUnreadableFile(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs file permissions that apply to the test user")
+	}
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "ok.txt"), []byte("ok"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "locked.txt"), []byte("no"), 0000)
+
+	var buf bytes.Buffer
+	skipped, err := tarArchive(&buf, archiveSpec{root: dir, sources: []archiveSource{{path: dir}}})
+	if err != nil {
+		t.Fatalf("tarArchive: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0].name != "locked.txt" || !skipped[0].err {
+		t.Errorf("skipped = %+v, want locked.txt as an error", skipped)
+	}
+	contents := tarContents(t, &buf)
+	if contents["ok.txt"] != "ok" {
+		t.Error("readable file missing")
+	}
+	if !strings.Contains(contents[archiveManifestName], "locked.txt: cannot read") {
+		t.Errorf("manifest = %q", contents[archiveManifestName])
+	}
+}
+
+func TestZipHandlerDotfiles(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "sub", ".config"), []byte("c"), 0644)
+	cfg := &ZipConfig{Level: -1, Symlinks: symlinkFollow}
+
+	tests := []struct {
+		name     string
+		dotfiles bool
+		want     []string
+	}{
+		{"hidden", false, []string{"sub/", "sub/.config"}},
+		{"with -dotfiles", true, []string{".env", "sub/", "sub/.config"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			zipHandler(dir, cfg, newVisibility(tt.dotfiles, nil)).ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?format=tar", nil))
+			var got []string
+			for name := range tarContents(t, rec.Body) {
+				got = append(got, name)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZipHandlerLogsSkipped(t *testing.T) {
+	dir := symlinkTree(t)
+	buf := captureLog(t)
+
+	handler := accessLogMiddleware(zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkSkip}, nil))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip", nil))
+
+	if !strings.Contains(buf.String(), `"GET /__zip" 200`) || !strings.Contains(buf.String(), "skipped=5") {
+		t.Errorf("access log should note skipped entries: %s", buf.String())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// requestIdentity returns the authenticated identity behind a request: the
+// subject CN of a verified client certificate, or the basic auth username.
+// It returns "" for anonymous requests.
+func requestIdentity(r *http.Request) string {
+	if cert := verifiedClientCert(r); cert != nil {
+		return cert.Subject.CommonName
+	}
+	if validBasicAuth(r) {
+		return creds.Username
+	}
+	return ""
+}
+
+// verifiedClientCert returns the leaf certificate of a client chain that
+// was verified against the -tls-client-ca pool.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// parseList splits a comma-separated flag value, dropping blanks.
+func parseList(s string) []string {
+	var users []string
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			users = append(users, u)
+		}
+	}
+	return users
+}
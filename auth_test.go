@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+func withClientCert(cn string) *tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestRequestIdentity(t *testing.T) {
+	creds = &AuthCreds{Username: "admin", Password: "secret"}
+	defer func() { creds = nil }()
+
+	t.Run("anonymous", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if id := requestIdentity(req); id != "" {
+			t.Errorf("expected empty identity, got %q", id)
+		}
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+		if id := requestIdentity(req); id != "admin" {
+			t.Errorf("expected admin, got %q", id)
+		}
+	})
+
+	t.Run("wrong basic auth password", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:nope")))
+		if id := requestIdentity(req); id != "" {
+			t.Errorf("expected empty identity, got %q", id)
+		}
+	})
+
+	t.Run("client certificate wins", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = withClientCert("ci-runner")
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+		if id := requestIdentity(req); id != "ci-runner" {
+			t.Errorf("expected ci-runner, got %q", id)
+		}
+	})
+
+	t.Run("unverified TLS connection", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{}
+		if id := requestIdentity(req); id != "" {
+			t.Errorf("expected empty identity, got %q", id)
+		}
+	})
+}
+
+func TestParseList(t *testing.T) {
+	got := parseList(" alice, ,bob ,")
+	if len(got) != 2 || got[0] != "alice" || got[1] != "bob" {
+		t.Errorf("parseList = %v, want [alice bob]", got)
+	}
+	if got := parseList(""); got != nil {
+		t.Errorf("parseList(\"\") = %v, want nil", got)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"compress/gzip"
 	"io"
+	"mime"
 	"net/http"
+	"path"
+	"slices"
 	"strings"
 	"sync"
 )
@@ -17,6 +20,31 @@ var compressibleTypes = []string{
 	"image/svg+xml",
 }
 
+// incompressibleTypes and incompressibleExts describe files that are
+// already compressed, which archives store instead of deflating again.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/zstd",
+	"application/pdf",
+}
+
+var incompressibleExts = []string{
+	".7z", ".apk", ".avif", ".br", ".bz2", ".docx", ".epub", ".gz", ".heic", ".jar",
+	".jpg", ".jpeg", ".lz4", ".mkv", ".mp3", ".mp4", ".odt", ".png", ".pptx", ".rar",
+	".tgz", ".webm", ".webp", ".whl", ".woff2", ".xlsx", ".xz", ".zip", ".zst",
+}
+
 var gzipWriterPool = sync.Pool{
 	New: func() any {
 		return gzip.NewWriter(io.Discard)
@@ -50,6 +78,11 @@ func (w *gzipResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
@@ -96,3 +129,25 @@ func shouldCompress(contentType string) bool {
 	}
 	return false
 }
+
+// isCompressedFile reports whether name looks like an already-compressed
+// file, judged by its extension and the content type it maps to.
+func isCompressedFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return false
+	}
+	if slices.Contains(incompressibleExts, ext) {
+		return true
+	}
+	ct := strings.ToLower(mime.TypeByExtension(ext))
+	if ct == "" || shouldCompress(ct) {
+		return false
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+	return false
+}
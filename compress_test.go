@@ -44,6 +44,39 @@ func TestShouldCompress(t *testing.T) {
 	}
 }
 
+func TestIsCompressedFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"movie.mp4", true},
+		{"photo.JPG", true},
+		{"image.png", true},
+		{"song.mp3", true},
+		{"bundle.zip", true},
+		{"backup.tar.gz", true},
+		{"data.zst", true},
+		{"report.pdf", true},
+		{"font.woff2", true},
+		{"logo.svg", false},
+		{"index.html", false},
+		{"main.go", false},
+		{"notes.txt", false},
+		{"data.json", false},
+		{"archive.tar", false},
+		{"Makefile", false},
+		{"unknown.xyz123", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCompressedFile(tt.name); got != tt.want {
+				t.Errorf("isCompressedFile(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGzipMiddleware(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
@@ -3,24 +3,68 @@ package main
 import "time"
 
 type Config struct {
-	Addr       string
-	Timeout    time.Duration
-	TLS        *TLSConfig
-	Compress   bool
-	SPA        string // empty = disabled, otherwise fallback file
-	LiveReload *LiveReload
-	Upload     *UploadConfig
-	Zip        bool
-	WebUI      bool
-	Dotfiles   bool // show and allow access to dotfiles
+	Addr           string
+	Listen         []string           // -listen addresses, overrides Addr when set
+	PortAuto       bool               // move to the next free port when a TCP port is taken
+	Ready          func([]ListenInfo) // called once all listeners are bound
+	Timeout        time.Duration
+	AccessLog      bool
+	TLS            *TLSConfig
+	Compress       bool
+	SPA            string // empty = disabled, otherwise fallback file
+	LiveReload     *LiveReload
+	Upload         *UploadConfig
+	Zip            *ZipConfig
+	Manage         bool     // delete, rename, move and mkdir endpoints
+	ManageUsers    []string // identities allowed to manage files, empty = anyone authenticated
+	WebDAV         bool     // mount the served directory at /__dav/
+	WebDAVReadOnly bool     // keep WebDAV read-only even with uploads enabled
+	WebUI          bool
+	Dotfiles       bool     // show and allow access to dotfiles
+	Deny           []string // .gitignore-style patterns hidden everywhere
 }
 
 type TLSConfig struct {
-	Cert string
-	Key  string
+	Cert               string
+	Key                string
+	ClientCA           string // CA bundle for verifying client certificates (mutual TLS)
+	ClientAuthOptional bool   // accept clients without a certificate (basic auth fallback)
+	Addr               string // separate HTTPS address, empty = HTTPS on Config.Addr
+	RedirectHTTP       bool   // redirect Config.Addr to HTTPS when Addr is set
+	HTTP3              bool   // also serve HTTP/3 over QUIC on the HTTPS port
+}
+
+type ZipConfig struct {
+	Level    int    // compress/flate level: -1 default, 0 store only, 1 (fast) to 9 (small)
+	Symlinks string // skip, link or follow (within the served directory); "" = link for tar, follow for zip
+
+	MaxJobs       int   // archives built at once, further requests wait; 0 = unlimited
+	MaxBytes      int64 // uncompressed size per archive, 0 = unlimited
+	MaxFiles      int   // files per archive, 0 = unlimited
+	RatePerMinute int   // archives each client may start per minute, 0 = unlimited
+
+	CacheDir   string // where cached archives are kept
+	CacheBytes int64  // total size of cached archives, 0 = stream without caching
 }
 
 type UploadConfig struct {
 	Dir      string
 	MaxBytes int64
+	Users    []string // identities allowed to upload, empty = anyone
+	Conflict string   // rename (default), overwrite, skip or reject
+	Backup   bool     // keep a .bak copy of files replaced by overwrite
+
+	AllowExt     []string // lowercase extensions such as ".pdf", empty = any
+	DenyExt      []string
+	AllowMIME    []string // sniffed content types, "image/*" matches a family
+	DenyMIME     []string
+	UserQuota    int64 // bytes each identity may upload in total, 0 = unlimited
+	TotalQuota   int64 // bytes Dir may hold, 0 = unlimited
+	MinFreeBytes int64 // refuse uploads that would leave less free disk space
+
+	Hooks       []UploadHook  // run after each saved upload
+	HookTimeout time.Duration // per attempt, 0 = 30s
+	HookRetries int           // extra attempts after a failure
+
+	Hide *visibility // the served tree's policy; uploads may not write hidden paths
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Conflict policies decide what happens when an upload's target already
+// exists.
+const (
+	conflictRename    = "rename"    // keep both, saving the upload as name_1.ext
+	conflictOverwrite = "overwrite" // replace the existing file
+	conflictSkip      = "skip"      // keep the existing file and discard the upload
+	conflictReject    = "reject"    // fail with 409 Conflict
+)
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictRename, conflictOverwrite, conflictSkip, conflictReject:
+		return true
+	}
+	return false
+}
+
+// conflictPolicy returns the policy a request asked for, falling back to
+// the server default and then to rename.
+func conflictPolicy(requested, serverDefault string) (string, *uploadError) {
+	if requested == "" {
+		requested = serverDefault
+	}
+	if requested == "" {
+		return conflictRename, nil
+	}
+	if !validConflictPolicy(requested) {
+		return "", &uploadError{http.StatusBadRequest, "invalid conflict policy " + requested}
+	}
+	return requested, nil
+}
+
+// placeUpload moves the finished upload at src to dest according to
+// policy and returns where it ended up. skipped reports that dest already
+// existed and src was left alone for the caller to discard.
+func placeUpload(src, dest, policy string, backup bool) (final string, skipped bool, uerr *uploadError) {
+	if policy == conflictOverwrite {
+		return overwriteUpload(src, dest, backup)
+	}
+
+	// Claim the name without replacing anything, so a file created at
+	// dest since the caller last looked is never clobbered.
+	dir, name := filepath.Split(dest)
+	for attempt := 0; ; attempt++ {
+		err := moveNoReplace(src, dest)
+		if err == nil {
+			return dest, false, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", false, &uploadError{http.StatusInternalServerError, "failed to save file"}
+		}
+		switch policy {
+		case conflictSkip:
+			return dest, true, nil
+		case conflictReject:
+			return "", false, &uploadError{http.StatusConflict, "file already exists"}
+		}
+		if attempt == 100 {
+			return "", false, &uploadError{http.StatusConflict, "too many files named " + name}
+		}
+		dest, err = uniqueFilename(dir, name)
+		if err != nil {
+			return "", false, &uploadError{http.StatusConflict, err.Error()}
+		}
+	}
+}
+
+// overwriteUpload replaces dest with src, keeping a backup if asked.
+func overwriteUpload(src, dest string, backup bool) (string, bool, *uploadError) {
+	fi, err := os.Lstat(dest)
+	switch {
+	case err == nil:
+		if !fi.Mode().IsRegular() {
+			return "", false, &uploadError{http.StatusConflict, "target exists and is not a regular file"}
+		}
+		if backup {
+			if err := backupFile(dest); err != nil {
+				return "", false, &uploadError{http.StatusInternalServerError, "failed to back up existing file"}
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", false, &uploadError{http.StatusInternalServerError, "failed to save file"}
+	}
+
+	// Rename replaces an existing file atomically, so readers see either
+	// the old version or the new one, never a partial write.
+	if err := os.Rename(src, dest); err != nil {
+		return "", false, &uploadError{http.StatusInternalServerError, "failed to save file"}
+	}
+	return dest, false, nil
+}
+
+// moveNoReplace moves src to dest, failing with fs.ErrExist if dest
+// exists. A hard link either claims dest or fails, unlike os.Rename,
+// which silently replaces it.
+func moveNoReplace(src, dest string) error {
+	err := os.Link(src, dest)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		// No hard links here; an O_EXCL copy claims dest just as safely.
+		err = copyFile(src, dest)
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// backupFile keeps the current contents of path as
+// path.YYYYMMDD-HHMMSS.bak before it is overwritten.
+func backupFile(path string) error {
+	bak, err := uniqueFilename(filepath.Dir(path), filepath.Base(path)+"."+time.Now().Format("20060102-150405")+".bak")
+	if err != nil {
+		return err
+	}
+	// A hard link is instant and leaves path in place until the rename.
+	if err := os.Link(path, bak); err == nil {
+		return nil
+	}
+	return copyFile(path, bak)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// uniqueFilename returns a free path for name in dir, trying name_1.ext,
+// name_2.ext and so on if name is taken.
+func uniqueFilename(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		return path, nil
+	}
+
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+
+	for i := 1; i < 1000; i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("too many files named %s", name)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUniqueFilename(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := uniqueFilename(dir, "test.txt")
+	if err != nil || filepath.Base(path) != "test.txt" {
+		t.Errorf("uniqueFilename should return test.txt when file doesn't exist, got %s (%v)", filepath.Base(path), err)
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "test.txt"), []byte("content"), 0644)
+	path, _ = uniqueFilename(dir, "test.txt")
+	if filepath.Base(path) != "test_1.txt" {
+		t.Errorf("uniqueFilename should return test_1.txt when test.txt exists, got %s", filepath.Base(path))
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "test_1.txt"), []byte("content"), 0644)
+	path, _ = uniqueFilename(dir, "test.txt")
+	if filepath.Base(path) != "test_2.txt" {
+		t.Errorf("uniqueFilename should return test_2.txt when test.txt and test_1.txt exist, got %s", filepath.Base(path))
+	}
+
+	for i := 2; i < 1000; i++ {
+		_ = os.WriteFile(filepath.Join(dir, fmt.Sprintf("test_%d.txt", i)), nil, 0644)
+	}
+	if path, err := uniqueFilename(dir, "test.txt"); err == nil {
+		t.Errorf("expected an error once every name is taken, got %s", path)
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	tests := []struct {
+		requested, serverDefault string
+		want                     string
+		wantErr                  bool
+	}{
+		{"", "", conflictRename, false},
+		{"", conflictSkip, conflictSkip, false},
+		{conflictOverwrite, conflictReject, conflictOverwrite, false},
+		{"clobber", "", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := conflictPolicy(tt.requested, tt.serverDefault)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("conflictPolicy(%q, %q) = %q, %v", tt.requested, tt.serverDefault, got, err)
+		}
+	}
+}
+
+func TestUploadConflicts(t *testing.T) {
+	upload := func(t *testing.T, cfg *UploadConfig, query, content string) (int, uploadResponse) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "report.txt")
+		_, _ = part.Write([]byte(content))
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/__upload"+query, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(cfg).ServeHTTP(rec, req)
+
+		var resp uploadResponse
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	tests := []struct {
+		name        string
+		cfg         UploadConfig
+		query       string
+		wantStatus  int
+		wantFile    string // name the upload is saved as, "" if not saved
+		wantContent string // content of report.txt afterwards
+		wantSkipped bool
+	}{
+		{"default renames", UploadConfig{}, "", http.StatusOK, "report_1.txt", "old", false},
+		{"server overwrite", UploadConfig{Conflict: conflictOverwrite}, "", http.StatusOK, "report.txt", "new", false},
+		{"request overwrite", UploadConfig{}, "?conflict=overwrite", http.StatusOK, "report.txt", "new", false},
+		{"skip", UploadConfig{Conflict: conflictSkip}, "", http.StatusOK, "report.txt", "old", true},
+		{"reject", UploadConfig{}, "?conflict=reject", http.StatusConflict, "", "old", false},
+		{"invalid policy", UploadConfig{}, "?conflict=clobber", http.StatusBadRequest, "", "old", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_ = os.WriteFile(filepath.Join(dir, "report.txt"), []byte("old"), 0644)
+			cfg := tt.cfg
+			cfg.Dir, cfg.MaxBytes = dir, 1024
+
+			status, resp := upload(t, &cfg, tt.query, "new")
+			if status != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %+v", tt.wantStatus, status, resp)
+			}
+			if tt.wantFile != "" && (len(resp.Files) != 1 || resp.Files[0].Filename != tt.wantFile) {
+				t.Errorf("expected upload saved as %s, got %+v", tt.wantFile, resp.Files)
+			}
+			if tt.wantSkipped && !resp.Files[0].Skipped {
+				t.Error("expected upload to be reported as skipped")
+			}
+			if content, _ := os.ReadFile(filepath.Join(dir, "report.txt")); string(content) != tt.wantContent {
+				t.Errorf("expected report.txt = %q, got %q", tt.wantContent, content)
+			}
+
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), ".dserve-upload-") {
+					t.Errorf("temp file left behind: %s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestUploadOverwriteBackup(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "report.txt")
+	_ = os.WriteFile(target, []byte("v1"), 0644)
+	tmp := filepath.Join(dir, ".dserve-upload-1")
+	_ = os.WriteFile(tmp, []byte("v2"), 0644)
+
+	final, skipped, err := placeUpload(tmp, target, conflictOverwrite, true)
+	if err != nil || skipped || final != target {
+		t.Fatalf("placeUpload = %s, %v, %v", final, skipped, err)
+	}
+	if content, _ := os.ReadFile(target); string(content) != "v2" {
+		t.Errorf("expected new content, got %q", content)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "report.txt.*.bak"))
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v", backups)
+	}
+	if content, _ := os.ReadFile(backups[0]); string(content) != "v1" {
+		t.Errorf("expected backup to hold the previous version, got %q", content)
+	}
+}
+
+func TestUploadOverwriteDirectory(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "report.txt"), 0755)
+	tmp := filepath.Join(dir, ".dserve-upload-1")
+	_ = os.WriteFile(tmp, []byte("v2"), 0644)
+
+	if _, _, err := placeUpload(tmp, filepath.Join(dir, "report.txt"), conflictOverwrite, false); err == nil || err.status != http.StatusConflict {
+		t.Errorf("expected 409 when overwriting a directory, got %v", err)
+	}
+}
+
+func TestMoveNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, ".dserve-upload-1")
+	dest := filepath.Join(dir, "report.txt")
+	_ = os.WriteFile(src, []byte("new"), 0644)
+	_ = os.WriteFile(dest, []byte("old"), 0644)
+
+	if err := moveNoReplace(src, dest); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected fs.ErrExist, got %v", err)
+	}
+	if content, _ := os.ReadFile(dest); string(content) != "old" {
+		t.Errorf("existing file was replaced: %q", content)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source should be left in place: %v", err)
+	}
+
+	os.Remove(dest)
+	if err := moveNoReplace(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(dest); string(content) != "new" {
+		t.Errorf("expected moved content, got %q", content)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source should be gone after the move: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// diskFree is not implemented here; the minimum free space check is
+// skipped.
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFilenameBytes is the name length limit of common filesystems
+// (ext4, APFS, NTFS in UTF-16 units is looser).
+const maxFilenameBytes = 255
+
+// windowsReservedRe matches device names Windows refuses as filenames,
+// with or without an extension.
+var windowsReservedRe = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9¹²³]|lpt[0-9¹²³])(\.|$)`)
+
+// safeFilename turns a client-supplied name into a single path segment
+// that is safe to create on Linux, macOS and Windows. Unicode letters,
+// digits, spaces and punctuation are kept and the result is NFC-normalized,
+// so "Résumé 2026.pdf" stays as it is. Separators, control characters,
+// bidi overrides and characters Windows forbids become "_". Leading dots
+// are dropped so uploads cannot create dotfiles. It returns "" if nothing
+// usable is left.
+func safeFilename(name string) string {
+	// Some clients send a full path; keep only the last segment.
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), isBidiControl(r), strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, name)
+
+	// Windows silently drops trailing dots and spaces, so "a.txt." and
+	// "a.txt" would collide.
+	name = strings.TrimRight(strings.TrimLeft(name, ". "), ". ")
+	if windowsReservedRe.MatchString(name) {
+		name = "_" + name
+	}
+	return truncateFilename(name, maxFilenameBytes)
+}
+
+// isBidiControl reports whether r changes text direction, which can make
+// "txt.exe" display as "exe.txt".
+func isBidiControl(r rune) bool {
+	return r >= 0x202A && r <= 0x202E || r >= 0x2066 && r <= 0x2069 || r == 0x200E || r == 0x200F || r == 0x061C
+}
+
+// truncateFilename shortens name to at most max bytes on a character
+// boundary, keeping a short extension.
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	n := max - len(ext)
+	for n > 0 && !utf8.RuneStart(stem[n]) {
+		n--
+	}
+	return strings.TrimRight(stem[:n], ". ") + ext
+}
+
+// safeRelPath sanitizes a relative path such as "photos/2024/a.jpg" from a
+// folder upload, returning it slash-separated. Each segment is cleaned with
+// safeFilename. A path that tries to climb out with ".." keeps only its
+// last segment.
+func safeRelPath(name string) string {
+	segments := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	if slices.Contains(segments, "..") {
+		return safeFilename(segments[len(segments)-1])
+	}
+	var clean []string
+	for _, seg := range segments {
+		if seg = safeFilename(seg); seg != "" {
+			clean = append(clean, seg)
+		}
+	}
+	return strings.Join(clean, "/")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSafeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		// Plain names
+		{"ascii", "file.txt", "file.txt"},
+		{"dashes and underscores", "normal-file_123.txt", "normal-file_123.txt"},
+		{"spaces kept", "my file.txt", "my file.txt"},
+		{"punctuation kept", "notes (final) & v2 #3 [draft].md", "notes (final) & v2 #3 [draft].md"},
+
+		// Unicode
+		{"accents", "Résumé 2026.pdf", "Résumé 2026.pdf"},
+		{"cjk", "報告.docx", "報告.docx"},
+		{"cyrillic", "Отчёт.xlsx", "Отчёт.xlsx"},
+		{"arabic", "تقرير.pdf", "تقرير.pdf"},
+		{"emoji", "party 🎉.png", "party 🎉.png"},
+		{"nfd normalized to nfc", "Re\u0301sume\u0301.pdf", "Résumé.pdf"},
+		{"nbsp becomes space", "a\u00a0b.txt", "a b.txt"},
+		{"ideographic space becomes space", "a\u3000b.txt", "a b.txt"},
+
+		// Separators and traversal
+		{"traversal", "../../../etc/passwd", "passwd"},
+		{"absolute", "/absolute/path/file.txt", "file.txt"},
+		{"windows path", `C:\Users\me\report.pdf`, "report.pdf"},
+		{"dot dot", "..", ""},
+		{"trailing separator", "dir/", ""},
+
+		// Control and invisible characters
+		{"newline", "a\nb.txt", "a_b.txt"},
+		{"tab", "a\tb.txt", "a_b.txt"},
+		{"nul", "a\x00b.txt", "a_b.txt"},
+		{"delete", "a\x7fb.txt", "a_b.txt"},
+		{"c1 control", "a\u0085b.txt", "a_b.txt"},
+		{"bidi override", "invoice\u202Etxt.exe", "invoice_txt.exe"},
+		{"bidi isolate", "a\u2066b.txt", "a_b.txt"},
+		{"invalid utf8", "a\xffb.txt", "a_b.txt"},
+
+		// Characters Windows forbids
+		{"windows forbidden", "file<>|:*.txt", "file_____.txt"},
+		{"quotes and question mark", `what?"is".txt`, "what__is_.txt"},
+
+		// Leading and trailing dots and spaces
+		{"hidden", ".hidden", "hidden"},
+		{"leading dots", "...dots", "dots"},
+		{"leading spaces", "  spaced.txt", "spaced.txt"},
+		{"trailing dot", "report.txt.", "report.txt"},
+		{"trailing spaces", "report.txt  ", "report.txt"},
+		{"trailing dots and spaces", "report. . .", "report"},
+		{"only dots and spaces", ". . .", ""},
+		{"empty", "", ""},
+
+		// Windows reserved device names
+		{"con", "CON", "_CON"},
+		{"con lowercase with extension", "con.txt", "_con.txt"},
+		{"nul with double extension", "nul.tar.gz", "_nul.tar.gz"},
+		{"com1", "COM1.log", "_COM1.log"},
+		{"lpt9", "lpt9", "_lpt9"},
+		{"com superscript", "COM¹", "_COM¹"},
+		{"reserved after trim", "aux. ", "_aux"},
+		{"reserved prefix only", "console.txt", "console.txt"},
+		{"reserved inside", "my-con.txt", "my-con.txt"},
+		{"com without digit", "com.txt", "com.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := safeFilename(tt.input); got != tt.expected {
+				t.Errorf("safeFilename(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSafeFilenameLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		ext   string
+	}{
+		{"ascii", strings.Repeat("a", 300) + ".txt", ".txt"},
+		{"multibyte", strings.Repeat("報", 200) + ".docx", ".docx"},
+		{"long extension dropped", "a." + strings.Repeat("x", 300), ""},
+		{"trailing dot at cut", strings.Repeat("a", 250) + ". . . . . . . . . .pdf", ".pdf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := safeFilename(tt.input)
+			if len(got) > maxFilenameBytes {
+				t.Errorf("length %d exceeds %d", len(got), maxFilenameBytes)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("result is not valid UTF-8: %q", got)
+			}
+			if !strings.HasSuffix(got, tt.ext) {
+				t.Errorf("expected extension %q to survive, got %q", tt.ext, got)
+			}
+			stem := strings.TrimSuffix(got, tt.ext)
+			if strings.HasSuffix(stem, ".") || strings.HasSuffix(stem, " ") {
+				t.Errorf("stem ends in a dot or space: %q", stem)
+			}
+		})
+	}
+}
+
+func TestSafeFilenameIdempotent(t *testing.T) {
+	inputs := []string{"Résumé 2026.pdf", "Re\u0301sume\u0301.pdf", "CON", " .x. ", "a<b>.txt", strings.Repeat("報", 200) + ".docx"}
+	for _, in := range inputs {
+		once := safeFilename(in)
+		if twice := safeFilename(once); twice != once {
+			t.Errorf("safeFilename not idempotent for %q: %q then %q", in, once, twice)
+		}
+	}
+}
+
+func TestSafeRelPath(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"file.txt", "file.txt"},
+		{"photos/2024/a.jpg", "photos/2024/a.jpg"},
+		{`photos\2024\a.jpg`, "photos/2024/a.jpg"},
+		{"/sub/dir", "sub/dir"},
+		{"a//b/./c.txt", "a/b/c.txt"},
+		{"my folder/.git/config", "my folder/git/config"},
+		{"../../../etc/passwd", "passwd"},
+		{"a/../../b.txt", "b.txt"},
+		{"photos/Été 2026/plage.jpg", "photos/Été 2026/plage.jpg"},
+		{"con/aux.txt", "_con/_aux.txt"},
+		{"..", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := safeRelPath(tt.input); got != tt.expected {
+			t.Errorf("safeRelPath(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
@@ -2,6 +2,17 @@ module github.com/peteretelej/dserve/v3
 
 go 1.24
 
-require github.com/fsnotify/fsnotify v1.9.0
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.59.0
+	golang.org/x/net v0.43.0
+	golang.org/x/text v0.28.0
+	rsc.io/qr v0.2.0
+)
 
-require golang.org/x/sys v0.13.0 // indirect
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
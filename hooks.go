@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload hooks run after a file has been saved, for virus scanning,
+// thumbnailing or CI notifications. They run in the background so the
+// upload response is not held up.
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	maxHookOutput      = 4096 // bytes of hook output kept for the log
+)
+
+// UploadHook is either a webhook URL that receives the event as a JSON
+// POST, or a command run with the event in its environment and on stdin.
+type UploadHook struct {
+	URL     string
+	Command []string
+}
+
+func (h UploadHook) String() string {
+	if h.URL != "" {
+		return h.URL
+	}
+	return strings.Join(h.Command, " ")
+}
+
+// parseUploadHook treats http:// and https:// values as webhooks and
+// anything else as a command line split on spaces. Commands are exec'd
+// directly, without a shell.
+func parseUploadHook(s string) (UploadHook, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return UploadHook{URL: s}, nil
+	}
+	args := strings.Fields(s)
+	if len(args) == 0 {
+		return UploadHook{}, errors.New("empty upload hook")
+	}
+	return UploadHook{Command: args}, nil
+}
+
+// hookFlag collects repeated -upload-hook values.
+type hookFlag []UploadHook
+
+func (f *hookFlag) String() string {
+	var parts []string
+	for _, h := range *f {
+		parts = append(parts, h.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *hookFlag) Set(v string) error {
+	h, err := parseUploadHook(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, h)
+	return nil
+}
+
+// uploadEvent describes a saved upload. It is the webhook body and the
+// command's stdin.
+type uploadEvent struct {
+	Event    string    `json:"event"`
+	Filename string    `json:"filename"`
+	Path     string    `json:"path"` // relative to the upload directory
+	Size     int64     `json:"size"`
+	User     string    `json:"user,omitempty"`
+	SHA256   string    `json:"sha256"`
+	Time     time.Time `json:"time"`
+}
+
+func newUploadEvent(res uploadResult, user string) uploadEvent {
+	return uploadEvent{
+		Event:    "upload",
+		Filename: res.Filename,
+		Path:     res.Path,
+		Size:     res.Size,
+		User:     user,
+		SHA256:   res.SHA256,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// fireUploadHooks starts every configured hook for ev in the background.
+func fireUploadHooks(cfg *UploadConfig, ev uploadEvent) {
+	for _, h := range cfg.Hooks {
+		go runUploadHook(cfg, h, ev)
+	}
+}
+
+// runUploadHook runs h, retrying failures with a growing delay, and logs
+// each attempt.
+func runUploadHook(cfg *UploadConfig, h UploadHook, ev uploadEvent) {
+	timeout := cfg.HookTimeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	body, _ := json.Marshal(ev)
+
+	attempts := cfg.HookRetries + 1
+	for i := 1; i <= attempts; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		output, err := h.run(ctx, cfg, ev, body)
+		cancel()
+
+		if output != "" {
+			log.Printf("upload hook %s (%s): output: %s", h, ev.Path, output)
+		}
+		if err == nil {
+			log.Printf("upload hook %s (%s): ok in %s", h, ev.Path, time.Since(start).Round(time.Millisecond))
+			return
+		}
+		log.Printf("upload hook %s (%s): attempt %d/%d failed: %v", h, ev.Path, i, attempts, err)
+		if i < attempts {
+			time.Sleep(hookBackoff(i))
+		}
+	}
+}
+
+// hookBackoff is the delay before retry n: 1s, 2s, 4s, ... capped at 30s.
+var hookBackoff = func(n int) time.Duration {
+	return min(time.Second<<(n-1), 30*time.Second)
+}
+
+func (h UploadHook) run(ctx context.Context, cfg *UploadConfig, ev uploadEvent, body []byte) (string, error) {
+	if h.URL != "" {
+		return postHook(ctx, h.URL, body)
+	}
+	return execHook(ctx, h.Command, cfg, ev, body)
+}
+
+func postHook(ctx context.Context, url string, body []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dserve-upload-hook")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, maxHookOutput))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return hookOutput(out), fmt.Errorf("status %s", resp.Status)
+	}
+	return hookOutput(out), nil
+}
+
+func execHook(ctx context.Context, args []string, cfg *UploadConfig, ev uploadEvent, body []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	// Don't wait forever on grandchildren that keep the output pipe open.
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Env = append(os.Environ(),
+		"DSERVE_UPLOAD_FILE="+filepath.Join(cfg.Dir, filepath.FromSlash(ev.Path)),
+		"DSERVE_UPLOAD_PATH="+ev.Path,
+		"DSERVE_UPLOAD_FILENAME="+ev.Filename,
+		"DSERVE_UPLOAD_SIZE="+strconv.FormatInt(ev.Size, 10),
+		"DSERVE_UPLOAD_USER="+ev.User,
+		"DSERVE_UPLOAD_SHA256="+ev.SHA256,
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > maxHookOutput {
+		out = out[:maxHookOutput]
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out: %w", err)
+	}
+	return hookOutput(out), err
+}
+
+func hookOutput(b []byte) string {
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseUploadHook(t *testing.T) {
+	tests := []struct {
+		input   string
+		url     string
+		command []string
+		wantErr bool
+	}{
+		{"http://localhost:8080/hook", "http://localhost:8080/hook", nil, false},
+		{"https://ci.example/notify", "https://ci.example/notify", nil, false},
+		{"/usr/local/bin/scan --quiet", "", []string{"/usr/local/bin/scan", "--quiet"}, false},
+		{"  clamscan  ", "", []string{"clamscan"}, false},
+		{"", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		h, err := parseUploadHook(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUploadHook(%q) error = %v", tt.input, err)
+			continue
+		}
+		if h.URL != tt.url || strings.Join(h.Command, " ") != strings.Join(tt.command, " ") {
+			t.Errorf("parseUploadHook(%q) = %+v", tt.input, h)
+		}
+	}
+}
+
+func TestHookFlag(t *testing.T) {
+	var f hookFlag
+	_ = f.Set("http://localhost/hook")
+	_ = f.Set("scan --quiet")
+	if err := f.Set(" "); err == nil {
+		t.Error("expected error for empty hook")
+	}
+	if got := f.String(); got != "http://localhost/hook,scan --quiet" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+// logBuffer is a bytes.Buffer safe for hooks logging from goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends log output to a buffer for the rest of the test.
+func captureLog(t *testing.T) *logBuffer {
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestUploadWebhook(t *testing.T) {
+	events := make(chan uploadEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev uploadEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer hook.Close()
+
+	logs := captureLog(t)
+	dir := t.TempDir()
+	cfg := &UploadConfig{Dir: dir, MaxBytes: 1024, Hooks: []UploadHook{{URL: hook.URL}}}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "scan me.txt")
+	_, _ = part.Write([]byte("hello"))
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/__upload?path=inbox", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.TLS = withClientCert("ci-runner")
+	uploadHandler(cfg).ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case ev := <-events:
+		want := uploadEvent{Event: "upload", Filename: "scan me.txt", Path: "inbox/scan me.txt", Size: 5, User: "ci-runner",
+			SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}
+		ev.Time = time.Time{}
+		if ev != want {
+			t.Errorf("event = %+v\nwant %+v", ev, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	// Let the background hook finish logging before the test ends.
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), "ok in"); {
+		if time.Now().After(deadline) {
+			t.Fatal("hook success was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTusUploadHook(t *testing.T) {
+	events := make(chan uploadEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev uploadEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer hook.Close()
+
+	logs := captureLog(t)
+	handler := tusHandler(&UploadConfig{Dir: t.TempDir(), MaxBytes: 1024, Hooks: []UploadHook{{URL: hook.URL}}})
+	loc := tusCreate(t, handler, "5", tusMeta("filename", "a.txt"))
+	if rec := tusPatch(handler, loc, "0", "hello"); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch: expected 204, got %d", rec.Code)
+	}
+
+	// The checksum is computed in the background, after the PATCH returned.
+	select {
+	case ev := <-events:
+		if ev.Path != "a.txt" || ev.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), "ok in"); {
+		if time.Now().After(deadline) {
+			t.Fatal("hook success was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadHookRetries(t *testing.T) {
+	defer func(orig func(int) time.Duration) { hookBackoff = orig }(hookBackoff)
+	hookBackoff = func(int) time.Duration { return 0 }
+	logs := captureLog(t)
+
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "scanner busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+
+	cfg := &UploadConfig{HookRetries: 2}
+	runUploadHook(cfg, UploadHook{URL: hook.URL}, uploadEvent{Path: "a.txt"})
+
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+	out := logs.String()
+	for _, want := range []string{"attempt 1/3 failed: status 503", "output: scanner busy", "ok in"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestUploadHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	logs := captureLog(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	_ = os.WriteFile(script, []byte("#!/bin/sh\necho \"$DSERVE_UPLOAD_PATH $DSERVE_UPLOAD_SIZE $DSERVE_UPLOAD_USER $DSERVE_UPLOAD_FILE\"\ncat\n"), 0755)
+
+	cfg := &UploadConfig{Dir: dir}
+	runUploadHook(cfg, UploadHook{Command: []string{script}}, uploadEvent{Event: "upload", Path: "inbox/a.txt", Size: 5, User: "alice"})
+
+	out := logs.String()
+	want := "inbox/a.txt 5 alice " + filepath.Join(dir, "inbox", "a.txt")
+	if !strings.Contains(out, want) || !strings.Contains(out, `"event":"upload"`) {
+		t.Errorf("expected env and stdin in hook output, got:\n%s", out)
+	}
+}
+
+func TestUploadHookTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep")
+	}
+	logs := captureLog(t)
+
+	cfg := &UploadConfig{HookTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	runUploadHook(cfg, UploadHook{Command: []string{"sleep", "5"}}, uploadEvent{Path: "a.txt"})
+
+	if time.Since(start) > 3*time.Second {
+		t.Error("hook was not stopped at its timeout")
+	}
+	if out := logs.String(); !strings.Contains(out, "attempt 1/1 failed: timed out") {
+		t.Errorf("expected timeout in log, got:\n%s", out)
+	}
+}
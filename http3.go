@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns an HTTP/3 server for the UDP side of the HTTPS
+// listeners. It shares their handler and TLS settings, including client
+// certificate verification, so the whole middleware chain behaves the same
+// over QUIC.
+func newHTTP3Server(cfg *Config, handler http.Handler, tlsCfg *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:        handler,
+		TLSConfig:      http3.ConfigureTLSConfig(tlsCfg),
+		IdleTimeout:    cfg.Timeout * 10,
+		MaxHeaderBytes: 1 << 20,
+	}
+}
+
+// altSvcMiddleware advertises the HTTP/3 listener on HTTP/1.1 and HTTP/2
+// responses so browsers can switch to QUIC on their next request.
+func altSvcMiddleware(next http.Handler, h3 *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// Fails only until the UDP listener is up; skip the header then.
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert failed: %v", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}}
+}
+
+func TestHTTP3ServesMiddlewareChain(t *testing.T) {
+	creds = &AuthCreds{Username: "user", Password: "pass"}
+	defer func() { creds = nil }()
+
+	handler := BASICAUTH(gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("over " + r.Proto))
+	})))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("UDP not available: %v", err)
+	}
+	defer conn.Close()
+
+	cfg := &Config{Timeout: time.Minute}
+	h3 := newHTTP3Server(cfg, handler, testTLSConfig(t))
+	go func() { _ = h3.Serve(conn) }()
+	defer h3.Close()
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	url := "https://" + conn.LocalAddr().String() + "/"
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 3 {
+		t.Errorf("expected HTTP/3 response, got %s", resp.Proto)
+	}
+	if !strings.Contains(string(body), "HTTP/3") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestAltSvcMiddleware(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("UDP not available: %v", err)
+	}
+	defer conn.Close()
+
+	h3 := newHTTP3Server(&Config{Timeout: time.Minute}, fakeFSHandler, testTLSConfig(t))
+	handler := altSvcMiddleware(fakeFSHandler, h3)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("expected no Alt-Svc before the QUIC listener is up, got %q", got)
+	}
+
+	go func() { _ = h3.Serve(conn) }()
+	defer h3.Close()
+
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got := rec.Header().Get("Alt-Svc"); strings.Contains(got, `h3=":`+port+`"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected Alt-Svc advertising port %s, got %q", port, rec.Header().Get("Alt-Svc"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.Body.String() != "fs" {
+		t.Errorf("expected body 'fs', got %q", rec.Body.String())
+	}
+}
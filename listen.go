@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFlag collects repeated -listen values.
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Set(v string) error {
+	if v == "" {
+		return errors.New("empty listen address")
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// portAutoAttempts is how many following ports -port-auto tries.
+const portAutoAttempts = 100
+
+// openListeners binds every address. Supported forms are host:port
+// (including [ipv6]:port), unix:/path/to.sock and systemd, which takes over
+// all sockets passed via systemd socket activation (LISTEN_FDS). With
+// portAuto, a TCP port that is already in use moves on to the next free one.
+func openListeners(addrs []string, portAuto bool) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, addr := range addrs {
+		l, err := listenAddr(addr, portAuto)
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		lns = append(lns, l...)
+	}
+	return lns, nil
+}
+
+func listenAddr(addr string, portAuto bool) ([]net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return systemdListeners()
+	case strings.HasPrefix(addr, "unix:"):
+		ln, err := listenUnix(strings.TrimPrefix(addr, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	default:
+		ln, err := listenTCP(addr, portAuto)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+}
+
+func listenTCP(addr string, portAuto bool) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil || !portAuto || !isAddrInUse(err) {
+		return ln, err
+	}
+
+	host, portStr, splitErr := net.SplitHostPort(addr)
+	port, atoiErr := strconv.Atoi(portStr)
+	if splitErr != nil || atoiErr != nil || port == 0 {
+		return nil, err
+	}
+	for next := port + 1; next <= port+portAutoAttempts && next <= 65535; next++ {
+		ln, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(next)))
+		if err == nil || !isAddrInUse(err) {
+			return ln, err
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d: %w", port, port+portAutoAttempts, err)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("missing socket path")
+	}
+	// A socket left behind by a previous run would make Listen fail, but
+	// one that still answers belongs to a running server.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("address already in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdListenFdsStart is the first file descriptor passed by systemd.
+const systemdListenFdsStart = 3
+
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_PID not set for this process)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_FDS not set)")
+	}
+	// Children must not mistake these variables for their own sockets.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var lns []net.Listener
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(lns)
+			return nil, fmt.Errorf("systemd socket fd %d: %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
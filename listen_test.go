@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenFlag(t *testing.T) {
+	var l listenFlag
+	if err := l.Set(":9011"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("unix:/tmp/dserve.sock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(""); err == nil {
+		t.Error("expected error for empty address")
+	}
+	if got := l.String(); got != ":9011,unix:/tmp/dserve.sock" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestOpenListenersTCP(t *testing.T) {
+	lns, err := openListeners([]string{"127.0.0.1:0", "127.0.0.1:0"}, false)
+	if err != nil {
+		t.Fatalf("openListeners failed: %v", err)
+	}
+	defer closeListeners(lns)
+
+	if len(lns) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(lns))
+	}
+	for _, ln := range lns {
+		if ln.Addr().Network() != "tcp" {
+			t.Errorf("expected tcp listener, got %s", ln.Addr().Network())
+		}
+	}
+}
+
+func TestOpenListenersIPv6(t *testing.T) {
+	lns, err := openListeners([]string{"[::1]:0"}, false)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer closeListeners(lns)
+
+	if ip := lns[0].Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+		t.Errorf("expected ::1, got %v", ip)
+	}
+}
+
+func TestOpenListenersUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dserve.sock")
+
+	lns, err := openListeners([]string{"unix:" + sock}, false)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+	if lns[0].Addr().Network() != "unix" {
+		t.Errorf("expected unix listener, got %s", lns[0].Addr().Network())
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	// A live socket must not be taken over by a second server.
+	if second, err := openListeners([]string{"unix:" + sock}, false); err == nil {
+		closeListeners(second)
+		t.Fatal("expected an error binding over a socket in use")
+	}
+	if conn, err := net.Dial("unix", sock); err != nil {
+		t.Fatalf("first server lost its socket: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// Simulate a socket file left behind by a crashed process.
+	lns[0].(*net.UnixListener).SetUnlinkOnClose(false)
+	closeListeners(lns)
+	if _, err := os.Stat(sock); err != nil {
+		t.Fatalf("expected stale socket file: %v", err)
+	}
+
+	lns, err = openListeners([]string{"unix:" + sock}, false)
+	if err != nil {
+		t.Fatalf("rebinding over stale socket failed: %v", err)
+	}
+	closeListeners(lns)
+}
+
+func TestOpenListenersErrors(t *testing.T) {
+	for _, addr := range []string{"unix:", "not-an-address", "127.0.0.1:99999"} {
+		if lns, err := openListeners([]string{addr}, false); err == nil {
+			closeListeners(lns)
+			t.Errorf("expected error for %q", addr)
+		}
+	}
+
+	// A failure must not leak listeners opened earlier in the list.
+	sock := filepath.Join(t.TempDir(), "leak.sock")
+	if lns, err := openListeners([]string{"unix:" + sock, "not-an-address"}, false); err == nil {
+		closeListeners(lns)
+		t.Fatal("expected error for mixed addresses")
+	}
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		t.Error("listener opened before the failure is still accepting connections")
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if _, err := openListeners([]string{"systemd"}, false); err == nil {
+		t.Error("expected error without LISTEN_PID")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := openListeners([]string{"systemd"}, false); err == nil {
+		t.Error("expected error when LISTEN_PID belongs to another process")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	if _, err := openListeners([]string{"systemd"}, false); err == nil {
+		t.Error("expected error when LISTEN_FDS is 0")
+	}
+}
+
+func TestOpenListenersPortAuto(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	addr := taken.Addr().String()
+
+	if _, err := openListeners([]string{addr}, false); err == nil {
+		t.Fatal("expected error for port in use without -port-auto")
+	}
+
+	lns, err := openListeners([]string{addr}, true)
+	if err != nil {
+		t.Skipf("no free port after %s: %v", addr, err)
+	}
+	defer closeListeners(lns)
+
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+	gotPort := lns[0].Addr().(*net.TCPAddr).Port
+	if gotPort <= takenPort || gotPort > takenPort+portAutoAttempts {
+		t.Errorf("expected a port after %d, got %d", takenPort, gotPort)
+	}
+}
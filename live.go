@@ -2,48 +2,122 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// liveReloadScript connects with a relative URL so it follows the scheme and
+// port of the page, whether served over HTTP, HTTPS or both. "update"
+// events list changed stylesheets and images, which are swapped in place
+// with a cache-buster so the page keeps its state.
 var liveReloadScript = []byte(`<script>
 (function(){
   var es = new EventSource('/__livereload');
+  function bust(url) {
+    var u = new URL(url, location.href);
+    u.searchParams.set('livereload', Date.now());
+    return u.href;
+  }
+  function changed(url, paths) {
+    try { return paths.indexOf(decodeURIComponent(new URL(url, location.href).pathname)) !== -1; }
+    catch (err) { return false; }
+  }
+  function swapStyles(paths) {
+    var links = document.querySelectorAll('link[rel="stylesheet"][href]'), n = 0;
+    links.forEach(function(l) { if (changed(l.href, paths)) n++; });
+    links.forEach(function(l) {
+      if (n && !changed(l.href, paths)) return; // else an @import changed: refresh all
+      var next = l.cloneNode();
+      next.href = bust(l.href);
+      next.onload = next.onerror = function() { l.remove(); };
+      l.after(next);
+    });
+  }
   es.onmessage = function(e) { if(e.data==='reload') location.reload(); };
+  es.addEventListener('update', function(e) {
+    var paths = JSON.parse(e.data), css = [], images = [], found = false;
+    paths.forEach(function(p) { (/\.css$/i.test(p) ? css : images).push(p); });
+    if (css.length) swapStyles(css);
+    if (!images.length) return;
+    document.querySelectorAll('img[src]').forEach(function(img) {
+      if (changed(img.src, images)) { img.src = bust(img.src); found = true; }
+    });
+    if (!found) swapStyles([]); // likely a CSS background
+  });
   es.onerror = function() { setTimeout(function(){ location.reload(); }, 1000); };
 })();
 </script>`)
 
+// hotSwapExts are changes the injected script applies without reloading.
+var hotSwapExts = map[string]bool{
+	".css": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".svg": true, ".webp": true, ".avif": true, ".ico": true,
+}
+
 type LiveReload struct {
-	clients   map[chan struct{}]bool
-	mu        sync.RWMutex
-	watcher   *fsnotify.Watcher
-	patterns  []string
-	debouncer *time.Timer
-	debounceMu sync.Mutex
+	clients      map[chan []string]bool // changed URL paths, nil = full reload
+	mu           sync.RWMutex
+	watcher      *fsnotify.Watcher
+	patterns     []string
+	debouncer    *time.Timer
+	debounceMu   sync.Mutex
+	pending      map[string]bool // URL paths changed since the last Notify, true if removed
+	watchMu      sync.Mutex
+	watched      map[string]bool // directories with an fsnotify watch
+	poller       *pollWatcher    // directories past the watch limit, nil until needed
+	pollInterval time.Duration
+	root         string      // directory passed to Watch
+	hide         *visibility // hidden paths never trigger a reload
 }
 
+// NewLiveReload watches with file system events, falling back to polling
+// every second when they are unavailable (for example when the inotify
+// instance limit is reached).
 func NewLiveReload(patterns string) (*LiveReload, error) {
+	lr := newLiveReload(patterns, time.Second)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return nil, err
+		log.Printf("live reload: file system events unavailable (%v), polling every %v instead", err, lr.pollInterval)
+		return lr, nil
 	}
+	lr.watcher = watcher
+	return lr, nil
+}
 
-	lr := &LiveReload{
-		clients:  make(map[chan struct{}]bool),
-		watcher:  watcher,
-		patterns: parsePatterns(patterns),
+// NewPollingLiveReload finds changes by scanning the tree every interval,
+// for file systems that never deliver events: NFS, SMB and some Docker
+// bind mounts.
+func NewPollingLiveReload(patterns string, interval time.Duration) *LiveReload {
+	return newLiveReload(patterns, interval)
+}
+
+func newLiveReload(patterns string, interval time.Duration) *LiveReload {
+	return &LiveReload{
+		clients:      make(map[chan []string]bool),
+		watched:      make(map[string]bool),
+		pollInterval: interval,
+		patterns:     parsePatterns(patterns),
 	}
+}
 
-	return lr, nil
+// Polling reports whether changes are found by polling rather than file
+// system events.
+func (lr *LiveReload) Polling() bool {
+	return lr.watcher == nil
 }
 
 func parsePatterns(s string) []string {
@@ -61,22 +135,85 @@ func parsePatterns(s string) []string {
 }
 
 func (lr *LiveReload) Watch(dir string) error {
+	lr.root = dir
+	return lr.addTree(dir, false)
+}
+
+// addTree watches dir and the directories below it. Directories past the
+// system's watch limit are polled instead. With announce set, as for a
+// directory that was just created, the files found count as changes.
+func (lr *LiveReload) addTree(dir string, announce bool) error {
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
-		if info.IsDir() {
-			name := info.Name()
-			if strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor" {
-				return filepath.SkipDir
+		if !info.IsDir() {
+			if announce {
+				lr.changed(path, false)
 			}
-			return lr.watcher.Add(path)
+			return nil
+		}
+		if lr.skipDir(path) {
+			return filepath.SkipDir
+		}
+		if lr.polled(path) {
+			return nil
+		}
+		if lr.watcher == nil {
+			lr.poll(path)
+			return nil
 		}
+		if err := lr.watcher.Add(path); err != nil {
+			if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EMFILE) {
+				return err
+			}
+			log.Printf("live reload: watch limit reached, polling %s every %v", path, lr.pollInterval)
+			lr.poll(path)
+			return nil
+		}
+		lr.watchMu.Lock()
+		lr.watched[path] = true
+		lr.watchMu.Unlock()
 		return nil
 	})
 }
 
+// skipDir reports directories live reload never looks into: those the
+// visibility policy hides, such as root dot directories and -deny matches.
+func (lr *LiveReload) skipDir(path string) bool {
+	return path != lr.root && lr.hiddenPath(path, true)
+}
+
+// unwatch drops the watches for a removed or renamed directory and
+// everything below it, reporting whether it was a watched directory.
+func (lr *LiveReload) unwatch(name string) bool {
+	lr.watchMu.Lock()
+	defer lr.watchMu.Unlock()
+	found := false
+	for dir := range lr.watched {
+		if dir == name || withinDir(name, dir) {
+			_ = lr.watcher.Remove(dir) // already gone if the directory was deleted
+			delete(lr.watched, dir)
+			found = true
+		}
+	}
+	return found
+}
+
+// hiddenPath reports whether a watched path is hidden by -deny or the
+// dotfile rule, so changes to it are not announced.
+func (lr *LiveReload) hiddenPath(name string, isDir bool) bool {
+	rel, err := filepath.Rel(lr.root, name)
+	if err != nil {
+		return false
+	}
+	return lr.hide.hidden(filepath.ToSlash(rel), isDir)
+}
+
 func (lr *LiveReload) Start() {
+	if lr.watcher == nil {
+		return // the poller started with Watch
+	}
 	go func() {
 		for {
 			select {
@@ -84,27 +221,95 @@ func (lr *LiveReload) Start() {
 				if !ok {
 					return
 				}
-				if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
-					if lr.matchesPattern(event.Name) {
-						lr.notifyDebounced()
-					}
-				}
-			case _, ok := <-lr.watcher.Errors:
+				lr.handle(event)
+			case err, ok := <-lr.watcher.Errors:
 				if !ok {
 					return
 				}
+				log.Printf("live reload: %v", err)
 			}
 		}
 	}()
 }
 
-func (lr *LiveReload) notifyDebounced() {
+// handle reacts to one file system event. New directories are watched
+// as they appear, so a fresh dist/ after a clean build is picked up.
+func (lr *LiveReload) handle(event fsnotify.Event) {
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if !lr.skipDir(event.Name) {
+				if err := lr.addTree(event.Name, true); err != nil {
+					log.Printf("live reload: watching %s: %v", event.Name, err)
+				}
+			}
+			return
+		}
+		lr.changed(event.Name, false)
+	case event.Op&fsnotify.Write != 0:
+		lr.changed(event.Name, false)
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// A renamed directory comes back as a Create under its new name.
+		if lr.unwatch(event.Name) {
+			if !lr.hiddenPath(event.Name, true) {
+				lr.notifyDebounced(event.Name, true)
+			}
+			return
+		}
+		lr.changed(event.Name, true)
+	}
+}
+
+// changed announces a file that was written, created or removed, if it
+// matches the watch patterns and is not hidden.
+func (lr *LiveReload) changed(name string, removed bool) {
+	if lr.matchesPattern(name) && !lr.hiddenPath(name, false) {
+		lr.notifyDebounced(name, removed)
+	}
+}
+
+// notifyDebounced records a changed file and notifies clients once
+// changes stop for 100ms, with every file changed in between. A removed
+// file always means a full reload.
+func (lr *LiveReload) notifyDebounced(name string, removed bool) {
 	lr.debounceMu.Lock()
 	defer lr.debounceMu.Unlock()
+	if lr.pending == nil {
+		lr.pending = make(map[string]bool)
+	}
+	p := lr.urlPath(name)
+	lr.pending[p] = lr.pending[p] || removed
 	if lr.debouncer != nil {
 		lr.debouncer.Stop()
 	}
-	lr.debouncer = time.AfterFunc(100*time.Millisecond, lr.Notify)
+	lr.debouncer = time.AfterFunc(100*time.Millisecond, lr.flush)
+}
+
+func (lr *LiveReload) flush() {
+	lr.debounceMu.Lock()
+	paths := make([]string, 0, len(lr.pending))
+	reload := false
+	for p, removed := range lr.pending {
+		paths = append(paths, p)
+		reload = reload || removed
+	}
+	lr.pending = nil
+	lr.debounceMu.Unlock()
+	if reload {
+		lr.Notify()
+		return
+	}
+	sort.Strings(paths)
+	lr.Notify(paths...)
+}
+
+// urlPath turns a watched file name into the URL path it is served at.
+func (lr *LiveReload) urlPath(name string) string {
+	rel, err := filepath.Rel(lr.root, name)
+	if err != nil {
+		rel = name
+	}
+	return "/" + filepath.ToSlash(rel)
 }
 
 func (lr *LiveReload) matchesPattern(name string) bool {
@@ -128,13 +333,31 @@ func (lr *LiveReload) matchesPattern(name string) bool {
 	return false
 }
 
-func (lr *LiveReload) Notify() {
+// Notify tells clients that paths changed. Stylesheets and images are
+// swapped in place; anything else, or no paths at all, reloads the page.
+func (lr *LiveReload) Notify(paths ...string) {
+	for _, p := range paths {
+		if !hotSwapExts[strings.ToLower(path.Ext(p))] {
+			paths = nil
+			break
+		}
+	}
 	lr.mu.RLock()
 	defer lr.mu.RUnlock()
 	for ch := range lr.clients {
 		select {
-		case ch <- struct{}{}:
+		case ch <- paths:
 		default:
+			// The client hasn't taken the last batch yet: reload instead
+			// of losing either.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- nil:
+			default:
+			}
 		}
 	}
 }
@@ -145,7 +368,7 @@ func (lr *LiveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	ch := make(chan struct{}, 1)
+	ch := make(chan []string, 1)
 	lr.mu.Lock()
 	lr.clients[ch] = true
 	lr.mu.Unlock()
@@ -167,8 +390,13 @@ func (lr *LiveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	for {
 		select {
-		case <-ch:
-			fmt.Fprintf(w, "data: reload\n\n")
+		case paths := <-ch:
+			if paths == nil {
+				fmt.Fprintf(w, "data: reload\n\n")
+			} else {
+				data, _ := json.Marshal(paths)
+				fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+			}
 			flusher.Flush()
 		case <-r.Context().Done():
 			return
@@ -177,6 +405,14 @@ func (lr *LiveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (lr *LiveReload) Close() error {
+	lr.watchMu.Lock()
+	if lr.poller != nil {
+		lr.poller.stop()
+	}
+	lr.watchMu.Unlock()
+	if lr.watcher == nil {
+		return nil
+	}
 	return lr.watcher.Close()
 }
 
@@ -225,8 +461,8 @@ func liveReloadMiddleware(next http.Handler, lr *LiveReload) http.Handler {
 
 type liveResponseRecorder struct {
 	http.ResponseWriter
-	body       *bytes.Buffer
-	statusCode int
+	body        *bytes.Buffer
+	statusCode  int
 	wroteHeader bool
 }
 
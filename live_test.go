@@ -168,7 +168,7 @@ func TestFileWatcher(t *testing.T) {
 	lr.Start()
 
 	notified := make(chan struct{}, 1)
-	ch := make(chan struct{}, 1)
+	ch := make(chan []string, 1)
 	lr.mu.Lock()
 	lr.clients[ch] = true
 	lr.mu.Unlock()
@@ -194,10 +194,184 @@ func TestLiveReloadScriptContent(t *testing.T) {
 	if !bytes.Contains(liveReloadScript, []byte("EventSource")) {
 		t.Error("script should use EventSource for SSE")
 	}
-	if !bytes.Contains(liveReloadScript, []byte("/__livereload")) {
-		t.Error("script should connect to /__livereload endpoint")
+	if !bytes.Contains(liveReloadScript, []byte("EventSource('/__livereload')")) {
+		t.Error("script should connect to the same-origin /__livereload endpoint so HTTP and HTTPS pages both work")
 	}
 	if !bytes.Contains(liveReloadScript, []byte("location.reload()")) {
 		t.Error("script should call location.reload() on message")
 	}
+	if !bytes.Contains(liveReloadScript, []byte("addEventListener('update'")) {
+		t.Error("script should handle update events for stylesheets and images")
+	}
+}
+
+// readSSE collects what lr sends to one client while notify runs.
+func readSSE(t *testing.T, lr *LiveReload, notify func()) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/__livereload", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		lr.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	notify()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-done
+	return rec.Body.String()
+}
+
+func TestNotifyHotSwap(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  string
+	}{
+		{"no paths", nil, "data: reload\n\n"},
+		{"stylesheet", []string{"/css/site.css"}, "event: update\ndata: [\"/css/site.css\"]\n\n"},
+		{"stylesheet and image", []string{"/a.CSS", "/img/logo.png"}, "event: update\ndata: [\"/a.CSS\",\"/img/logo.png\"]\n\n"},
+		{"script", []string{"/site.css", "/app.js"}, "data: reload\n\n"},
+		{"html", []string{"/index.html"}, "data: reload\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lr, err := NewLiveReload("*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lr.Close()
+
+			got := readSSE(t, lr, func() { lr.Notify(tt.paths...) })
+			if !strings.HasSuffix(got, tt.want) {
+				t.Errorf("got %q, want it to end with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyDebouncedPaths(t *testing.T) {
+	dir := t.TempDir()
+	lr, err := NewLiveReload("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	lr.root = dir
+
+	got := readSSE(t, lr, func() {
+		lr.notifyDebounced(filepath.Join(dir, "css", "b.css"), false)
+		lr.notifyDebounced(filepath.Join(dir, "a.css"), false)
+		lr.notifyDebounced(filepath.Join(dir, "a.css"), false)
+	})
+	if want := "event: update\ndata: [\"/a.css\",\"/css/b.css\"]\n\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want one batched update %q", got, want)
+	}
+}
+
+// subscribe registers a client channel the way ServeHTTP does.
+func subscribe(lr *LiveReload) chan []string {
+	ch := make(chan []string, 1)
+	lr.mu.Lock()
+	lr.clients[ch] = true
+	lr.mu.Unlock()
+	return ch
+}
+
+// expectNotify waits for the next batch, failing on timeout. A nil
+// result is a full reload.
+func expectNotify(t *testing.T, ch chan []string, what string) []string {
+	t.Helper()
+	select {
+	case paths := <-ch:
+		return paths
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a notification for %s, timed out", what)
+		return nil
+	}
+}
+
+func TestWatchNewDirectories(t *testing.T) {
+	dir := t.TempDir()
+	lr, err := NewLiveReload("*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	if err := lr.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+	lr.Start()
+	ch := subscribe(lr)
+
+	dist := filepath.Join(dir, "dist", "pages")
+	if err := os.MkdirAll(dist, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond) // let the new directories be watched
+
+	if err := os.WriteFile(filepath.Join(dist, "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectNotify(t, ch, "a file in a new directory"); got != nil {
+		t.Errorf("expected a reload, got %v", got)
+	}
+
+	lr.watchMu.Lock()
+	watched := lr.watched[dist]
+	lr.watchMu.Unlock()
+	if !watched {
+		t.Fatal("new directory should be watched")
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "dist")); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectNotify(t, ch, "a removed directory"); got != nil {
+		t.Errorf("expected a reload, got %v", got)
+	}
+	time.Sleep(200 * time.Millisecond)
+	lr.watchMu.Lock()
+	defer lr.watchMu.Unlock()
+	if len(lr.watched) != 1 {
+		t.Errorf("removed directories should be unwatched, still watching %v", lr.watched)
+	}
+}
+
+func TestWatchRemoveAndRename(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.html")
+	style := filepath.Join(dir, "site.css")
+	_ = os.WriteFile(page, []byte("<html></html>"), 0644)
+	_ = os.WriteFile(style, []byte("body{}"), 0644)
+
+	lr, err := NewLiveReload("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	if err := lr.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+	lr.Start()
+	ch := subscribe(lr)
+
+	if err := os.Remove(style); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectNotify(t, ch, "a removed stylesheet"); got != nil {
+		t.Errorf("a removed stylesheet should reload the page, got %v", got)
+	}
+
+	if err := os.Rename(page, filepath.Join(dir, "other.html")); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectNotify(t, ch, "a renamed file"); got != nil {
+		t.Errorf("a renamed file should reload the page, got %v", got)
+	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollWatcher finds changes by scanning directories and comparing each
+// file's mtime and size, for trees fsnotify cannot watch. What it finds
+// goes through LiveReload.handle like any fsnotify event.
+type pollWatcher struct {
+	lr   *LiveReload
+	done chan struct{}
+
+	mu    sync.Mutex
+	roots []string
+	files map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// poll starts polling dir and everything below it. Its current files are
+// the baseline; only later changes are announced.
+func (lr *LiveReload) poll(dir string) {
+	lr.watchMu.Lock()
+	if lr.poller == nil {
+		lr.poller = &pollWatcher{lr: lr, done: make(chan struct{}), files: map[string]fileStamp{}}
+		go lr.poller.run(lr.pollInterval)
+	}
+	p := lr.poller
+	lr.watchMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roots = append(p.roots, dir)
+	p.scanRoot(dir, p.files)
+}
+
+// polled reports whether dir is inside a polled tree.
+func (lr *LiveReload) polled(dir string) bool {
+	lr.watchMu.Lock()
+	p := lr.poller
+	lr.watchMu.Unlock()
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, root := range p.roots {
+		if dir == root || withinDir(root, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pollWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.scan()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pollWatcher) stop() {
+	close(p.done)
+}
+
+// scan compares the polled trees with the last scan and hands the
+// differences to LiveReload.handle.
+func (p *pollWatcher) scan() {
+	p.mu.Lock()
+	files := make(map[string]fileStamp, len(p.files))
+	for _, root := range p.roots {
+		p.scanRoot(root, files)
+	}
+	old := p.files
+	p.files = files
+	p.mu.Unlock()
+
+	for name, stamp := range files {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			p.lr.handle(fsnotify.Event{Name: name, Op: fsnotify.Create})
+		case !prev.modTime.Equal(stamp.modTime) || prev.size != stamp.size:
+			p.lr.handle(fsnotify.Event{Name: name, Op: fsnotify.Write})
+		}
+	}
+	for name := range old {
+		if _, ok := files[name]; !ok {
+			p.lr.handle(fsnotify.Event{Name: name, Op: fsnotify.Remove})
+		}
+	}
+}
+
+// scanRoot records the files under root, skipping what live reload
+// skips.
+func (p *pollWatcher) scanRoot(root string, files map[string]fileStamp) {
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != root && p.lr.skipDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files[path] = fileStamp{info.ModTime(), info.Size()}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "site", "index.html")
+	_ = os.MkdirAll(filepath.Dir(page), 0755)
+	_ = os.WriteFile(page, []byte("<html></html>"), 0644)
+	_ = os.MkdirAll(filepath.Join(dir, "node_modules"), 0755)
+
+	lr, err := NewLiveReload("*.html,*.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	lr.root = dir
+	lr.hide = newVisibility(false, []string{"node_modules/"})
+	lr.pollInterval = 20 * time.Millisecond
+	lr.poll(dir)
+	ch := subscribe(lr)
+
+	if !lr.polled(filepath.Join(dir, "site")) {
+		t.Error("directories below a polled root should count as polled")
+	}
+
+	steps := []struct {
+		name   string
+		change func() error
+		want   []string // nil = full reload
+	}{
+		{"created", func() error {
+			return os.WriteFile(filepath.Join(dir, "site", "a.css"), []byte("a{}"), 0644)
+		}, []string{"/site/a.css"}},
+		{"resized", func() error {
+			return os.WriteFile(page, []byte("<html><body></body></html>"), 0644)
+		}, nil},
+		{"touched", func() error {
+			later := time.Now().Add(time.Minute)
+			return os.Chtimes(filepath.Join(dir, "site", "a.css"), later, later)
+		}, []string{"/site/a.css"}},
+		{"removed", func() error {
+			return os.Remove(filepath.Join(dir, "site", "a.css"))
+		}, nil},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		got := expectNotify(t, ch, step.name)
+		if (got == nil) != (step.want == nil) || len(got) != len(step.want) || got != nil && got[0] != step.want[0] {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "node_modules", "x.html"), []byte("x"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644)
+	select {
+	case got := <-ch:
+		t.Errorf("skipped directories and other patterns should not notify, got %v", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPollingLiveReload(t *testing.T) {
+	dir := t.TempDir()
+	lr := NewPollingLiveReload("*.html", 20*time.Millisecond)
+	defer lr.Close()
+	if !lr.Polling() {
+		t.Fatal("expected polling mode")
+	}
+	if err := lr.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+	lr.Start()
+	ch := subscribe(lr)
+
+	// New directories need no watch of their own.
+	if err := os.MkdirAll(filepath.Join(dir, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dist", "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := expectNotify(t, ch, "a new file"); got != nil {
+		t.Errorf("expected a reload, got %v", got)
+	}
+
+	lr.watchMu.Lock()
+	defer lr.watchMu.Unlock()
+	if len(lr.watched) != 0 {
+		t.Errorf("polling should not use file system watches, got %v", lr.watched)
+	}
+}
@@ -1,36 +1,84 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+var (
+	listenAddrs listenFlag
+	uploadHooks hookFlag
+)
+
+func init() {
+	flag.Var(&listenAddrs, "listen", "address to listen on, repeatable: host:port, [ipv6]:port, unix:/path.sock or systemd (overrides -port and -local)")
+	flag.Var(&uploadHooks, "upload-hook", "run after each upload, repeatable: an http(s) URL to POST JSON to, or a command to exec")
+}
+
 var (
 	dir       = flag.String("dir", "./", "directory to serve")
-	port      = flag.Int("port", 9011, "port to serve on")
+	port      = flag.Int("port", 9011, "port to serve on (0 picks a free port)")
+	portAuto  = flag.Bool("port-auto", false, "use the next free port if -port is taken")
 	local     = flag.Bool("local", false, "serve on localhost only")
 	basicauth = flag.String("basicauth", "", "basic auth credentials (user:pass)")
 	timeout   = flag.Duration("timeout", time.Minute*3, "server timeout")
 
-	tlsEnabled = flag.Bool("tls", false, "enable HTTPS")
-	certFile   = flag.String("tls-cert", "", "TLS certificate file")
-	keyFile    = flag.String("tls-key", "", "TLS key file")
-
-	compress = flag.Bool("compress", false, "enable gzip compression")
-	spa      = flag.String("spa", "", "enable SPA mode with fallback file (default: index.html if flag present)")
-	live     = flag.String("live", "", "enable live reload with watch pattern (default: * if flag present)")
-	upload   = flag.Bool("upload", false, "enable file uploads")
-	uploadDir = flag.String("upload-dir", "", "upload destination directory")
-	maxSize  = flag.String("max-size", "100MB", "maximum upload size")
-	zipDl    = flag.Bool("zip", false, "enable directory download as zip")
-	webUI    = flag.Bool("webui", false, "enable web UI for directory listing")
-	dotfiles = flag.Bool("dotfiles", false, "show and allow access to dotfiles (use with caution)")
+	jsonStartup = flag.Bool("json-startup", false, "print bound addresses as one JSON line instead of the startup banner")
+	showQR      = flag.Bool("qr", false, "print a QR code of the LAN URL for phone testing")
+
+	tlsEnabled   = flag.Bool("tls", false, "enable HTTPS")
+	certFile     = flag.String("tls-cert", "", "TLS certificate file")
+	keyFile      = flag.String("tls-key", "", "TLS key file")
+	clientCA     = flag.String("tls-client-ca", "", "CA file for verifying client certificates (enables mutual TLS)")
+	clientAuth   = flag.String("tls-client-auth", "require", "client certificate mode with -tls-client-ca: require or optional (basic auth fallback)")
+	tlsPort      = flag.Int("tls-port", 0, "serve HTTPS on this port alongside HTTP on -port (requires -tls)")
+	tlsRedirect  = flag.Bool("tls-redirect", false, "redirect HTTP requests to HTTPS with 308 (requires -tls-port)")
+	http3Enabled = flag.Bool("http3", false, "also serve HTTP/3 (QUIC) on the HTTPS port over UDP (requires -tls)")
+	accessLog    = flag.Bool("access-log", false, "log every request with the authenticated user")
+
+	compress    = flag.Bool("compress", false, "enable gzip compression")
+	spa         = flag.String("spa", "", "enable SPA mode with fallback file (default: index.html if flag present)")
+	live        = flag.String("live", "", "enable live reload with watch pattern (default: * if flag present)")
+	livePoll    = flag.Duration("live-poll", 0, "with -live, poll for changes at this interval instead of file system events (NFS, SMB, Docker mounts)")
+	upload      = flag.Bool("upload", false, "enable file uploads")
+	uploadDir   = flag.String("upload-dir", "", "upload destination directory")
+	uploadUsers = flag.String("upload-users", "", "comma-separated users allowed to upload and manage files (basic auth user or client certificate CN)")
+	maxSize     = flag.String("max-size", "100MB", "maximum upload size")
+	conflict    = flag.String("upload-conflict", "rename", "when an upload's name is taken: rename, overwrite, skip or reject")
+	backup      = flag.Bool("upload-backup", false, "keep a timestamped .bak of files replaced by overwrite")
+	allowExt    = flag.String("upload-allow-ext", "", "comma-separated file extensions uploads must have (e.g. .pdf,.png)")
+	denyExt     = flag.String("upload-deny-ext", "", "comma-separated file extensions to refuse (e.g. .exe,.sh)")
+	allowMIME   = flag.String("upload-allow-mime", "", "comma-separated sniffed content types to accept (e.g. image/*,application/pdf)")
+	denyMIME    = flag.String("upload-deny-mime", "", "comma-separated sniffed content types to refuse")
+	userQuota   = flag.String("upload-quota-user", "", "total bytes each user may upload (e.g. 1GB)")
+	totalQuota  = flag.String("upload-quota-total", "", "maximum size of the upload directory (e.g. 10GB)")
+	minFree     = flag.String("upload-min-free", "", "refuse uploads that would leave less free disk space (e.g. 2GB)")
+	hookTimeout = flag.Duration("upload-hook-timeout", defaultHookTimeout, "time limit for each upload hook attempt")
+	hookRetries = flag.Int("upload-hook-retries", 2, "retries for a failed upload hook")
+	zipDl       = flag.Bool("zip", false, "enable directory download as zip or tar (tar, tar.gz, tar.zst)")
+	zipLinks    = flag.String("zip-symlinks", "", "symlinks in archives: skip, link (store the link) or follow (only within the served directory); default link for tar, follow for zip")
+	zipLevel    = flag.Int("zip-level", -1, "archive compression level: 0 (store) to 9 (smallest), -1 for the default")
+	zipJobs     = flag.Int("zip-max-jobs", 2, "archives built at once, others wait (0 = unlimited)")
+	zipMaxSize  = flag.String("zip-max-size", "", "refuse archives over this uncompressed size (e.g. 10GB)")
+	zipMaxFiles = flag.Int("zip-max-files", 0, "refuse archives with more files than this (0 = unlimited)")
+	zipRate     = flag.Int("zip-rate", 0, "archive downloads each client may start per minute (0 = unlimited)")
+	zipCache    = flag.String("zip-cache", "", "cache archives on disk up to this total size so downloads can resume (e.g. 5GB)")
+	zipCacheDir = flag.String("zip-cache-dir", "", "directory for -zip-cache (default: the user cache directory)")
+	manage      = flag.Bool("manage", false, "enable delete, rename, move and mkdir endpoints (requires -basicauth or -tls-client-ca)")
+	webdavOn    = flag.Bool("webdav", false, "serve the directory over WebDAV at /__dav/ (writable in the upload directory with -upload)")
+	webdavRO    = flag.Bool("webdav-readonly", false, "keep WebDAV read-only even when -upload is set")
+	webUI       = flag.Bool("webui", false, "enable web UI for directory listing")
+	dotfiles    = flag.Bool("dotfiles", false, "show and allow access to dotfiles (use with caution)")
+	deny        = flag.String("deny", "", "comma-separated .gitignore-style patterns to hide everywhere (e.g. .env,*.key,node_modules/)")
 )
 
 func main() {
@@ -52,12 +100,71 @@ func main() {
 	}
 
 	cfg := &Config{
-		Addr:     fmt.Sprintf("%s:%d", addr, *port),
-		Timeout:  *timeout,
-		Compress: *compress,
-		Zip:      *zipDl,
-		WebUI:    *webUI,
-		Dotfiles: *dotfiles,
+		Addr:           fmt.Sprintf("%s:%d", addr, *port),
+		Listen:         listenAddrs,
+		PortAuto:       *portAuto,
+		Timeout:        *timeout,
+		AccessLog:      *accessLog,
+		Compress:       *compress,
+		Manage:         *manage,
+		ManageUsers:    parseList(*uploadUsers),
+		WebDAV:         *webdavOn,
+		WebDAVReadOnly: *webdavRO,
+		WebUI:          *webUI,
+		Dotfiles:       *dotfiles,
+		Deny:           parseList(*deny),
+	}
+
+	if *zipDl {
+		if *zipLevel < -1 || *zipLevel > 9 {
+			log.Fatalf("invalid zip-level %d: must be -1 to 9", *zipLevel)
+		}
+		if *zipLinks != "" && !validSymlinkPolicy(*zipLinks) {
+			log.Fatalf("invalid zip-symlinks %q: must be skip, link or follow", *zipLinks)
+		}
+		cfg.Zip = &ZipConfig{
+			Level:         *zipLevel,
+			Symlinks:      *zipLinks,
+			MaxJobs:       *zipJobs,
+			MaxFiles:      *zipMaxFiles,
+			RatePerMinute: *zipRate,
+		}
+		if *zipMaxSize != "" {
+			n, err := parseSize(*zipMaxSize)
+			if err != nil {
+				log.Fatalf("invalid zip-max-size: %v", err)
+			}
+			cfg.Zip.MaxBytes = n
+		}
+		if *zipCache != "" {
+			n, err := parseSize(*zipCache)
+			if err != nil {
+				log.Fatalf("invalid zip-cache: %v", err)
+			}
+			cfg.Zip.CacheBytes = n
+			cfg.Zip.CacheDir = *zipCacheDir
+			if cfg.Zip.CacheDir == "" {
+				cfg.Zip.CacheDir = defaultCacheDir()
+			}
+			if err := os.MkdirAll(cfg.Zip.CacheDir, 0700); err != nil {
+				log.Fatalf("zip-cache-dir: %v", err)
+			}
+			cacheDir, _ := filepath.Abs(cfg.Zip.CacheDir)
+			served, _ := filepath.Abs(".")
+			if withinDir(served, cacheDir) {
+				log.Fatal("-zip-cache-dir must be outside the served directory")
+			}
+		}
+	}
+
+	if cfg.Manage && *basicauth == "" && *clientCA == "" {
+		log.Fatal("-manage requires -basicauth or -tls-client-ca")
+	}
+
+	for _, p := range cfg.Deny {
+		if err := validDenyPattern(p); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if cfg.Dotfiles {
@@ -65,7 +172,31 @@ func main() {
 	}
 
 	if *tlsEnabled {
-		cfg.TLS = &TLSConfig{Cert: *certFile, Key: *keyFile}
+		cfg.TLS = &TLSConfig{Cert: *certFile, Key: *keyFile, ClientCA: *clientCA}
+		switch *clientAuth {
+		case "require":
+		case "optional":
+			// Without basic auth to fall back on, clients without a
+			// certificate would get in unauthenticated.
+			if *basicauth == "" {
+				log.Fatal("-tls-client-auth optional requires -basicauth")
+			}
+			cfg.TLS.ClientAuthOptional = true
+		default:
+			log.Fatalf("invalid tls-client-auth %q: must be require or optional", *clientAuth)
+		}
+		cfg.TLS.HTTP3 = *http3Enabled
+		if *tlsPort != 0 {
+			cfg.TLS.Addr = fmt.Sprintf("%s:%d", addr, *tlsPort)
+			cfg.TLS.RedirectHTTP = *tlsRedirect
+			if *clientCA != "" && !*tlsRedirect {
+				log.Println("-tls-client-ca: HTTP on -port redirects to HTTPS, since it can't check certificates")
+			}
+		} else if *tlsRedirect {
+			log.Fatal("-tls-redirect requires -tls-port")
+		}
+	} else if *clientCA != "" || *tlsPort != 0 || *http3Enabled {
+		log.Fatal("-tls-client-ca, -tls-port and -http3 require -tls")
 	}
 
 	if isFlagSet("spa") {
@@ -80,16 +211,28 @@ func main() {
 		if pattern == "" {
 			pattern = "*"
 		}
-		lr, err := NewLiveReload(pattern)
-		if err != nil {
-			log.Fatalf("Failed to initialize live reload: %v", err)
+		if *livePoll < 0 {
+			log.Fatalf("invalid live-poll %v: must be positive", *livePoll)
+		}
+		var lr *LiveReload
+		if *livePoll > 0 {
+			lr = NewPollingLiveReload(pattern, *livePoll)
+		} else {
+			var err error
+			lr, err = NewLiveReload(pattern)
+			if err != nil {
+				log.Fatalf("Failed to initialize live reload: %v", err)
+			}
 		}
+		lr.hide = newVisibility(cfg.Dotfiles, cfg.Deny)
 		if err := lr.Watch("."); err != nil {
 			log.Fatalf("Failed to watch directory: %v", err)
 		}
 		lr.Start()
 		defer lr.Close()
 		cfg.LiveReload = lr
+	} else if *livePoll != 0 {
+		log.Fatal("-live-poll requires -live")
 	}
 
 	if *upload {
@@ -101,26 +244,78 @@ func main() {
 		if dest == "" {
 			dest = "."
 		}
-		cfg.Upload = &UploadConfig{Dir: dest, MaxBytes: maxBytes}
+		if !validConflictPolicy(*conflict) {
+			log.Fatalf("invalid upload-conflict %q: must be rename, overwrite, skip or reject", *conflict)
+		}
+		cfg.Upload = &UploadConfig{
+			Dir:       dest,
+			MaxBytes:  maxBytes,
+			Users:     parseList(*uploadUsers),
+			Conflict:  *conflict,
+			Backup:    *backup,
+			AllowExt:  parseExtList(*allowExt),
+			DenyExt:   parseExtList(*denyExt),
+			AllowMIME: parseList(*allowMIME),
+			DenyMIME:  parseList(*denyMIME),
+			Hide:      newVisibility(cfg.Dotfiles, cfg.Deny),
+
+			Hooks:       uploadHooks,
+			HookTimeout: *hookTimeout,
+			HookRetries: *hookRetries,
+		}
+		for _, limit := range []struct {
+			flag  string
+			value string
+			dst   *int64
+		}{
+			{"upload-quota-user", *userQuota, &cfg.Upload.UserQuota},
+			{"upload-quota-total", *totalQuota, &cfg.Upload.TotalQuota},
+			{"upload-min-free", *minFree, &cfg.Upload.MinFreeBytes},
+		} {
+			if limit.value == "" {
+				continue
+			}
+			n, err := parseSize(limit.value)
+			if err != nil {
+				log.Fatalf("invalid %s: %v", limit.flag, err)
+			}
+			*limit.dst = n
+		}
 	}
 
-	protocol := "http"
-	if cfg.TLS != nil {
-		protocol = "https"
-	}
-	displayAddr := cfg.Addr
-	if displayAddr[0] == ':' {
-		displayAddr = "localhost" + displayAddr
-	}
-	fmt.Printf("Serving %s at %s://%s\n", *dir, protocol, displayAddr)
-	if cfg.LiveReload != nil {
-		fmt.Printf("Live reload enabled, watching: %s\n", *live)
-	}
-	if cfg.Upload != nil {
-		fmt.Printf("Uploads enabled (max: %s, dest: %s)\n", *maxSize, cfg.Upload.Dir)
-	}
-	if cfg.WebUI {
-		fmt.Printf("Browse files: %s://%s/__browse/\n", protocol, displayAddr)
+	cfg.Ready = func(infos []ListenInfo) {
+		if *jsonStartup {
+			if err := writeStartupJSON(os.Stdout, *dir, infos); err != nil {
+				log.Printf("writing startup JSON: %v", err)
+			}
+			return
+		}
+
+		writeStartupText(os.Stdout, *dir, infos)
+		if cfg.LiveReload != nil {
+			if cfg.LiveReload.Polling() {
+				fmt.Printf("Live reload enabled, watching: %s (polling every %v)\n", *live, cfg.LiveReload.pollInterval)
+			} else {
+				fmt.Printf("Live reload enabled, watching: %s\n", *live)
+			}
+		}
+		if cfg.TLS != nil && cfg.TLS.ClientCA != "" {
+			fmt.Printf("Client certificates verified against %s (%s)\n", cfg.TLS.ClientCA, *clientAuth)
+		}
+		if cfg.Upload != nil {
+			fmt.Printf("Uploads enabled (max: %s, dest: %s)\n", *maxSize, cfg.Upload.Dir)
+		}
+		base := primaryURL(infos)
+		if cfg.WebUI && base != "" {
+			fmt.Printf("Browse files: %s/__browse/\n", base)
+		}
+		if *showQR {
+			if u := lanURL(infos); u != "" {
+				if code, err := qrText(u); err == nil {
+					fmt.Printf("\nScan to open %s\n%s", u, code)
+				}
+			}
+		}
 	}
 
 	if err := Serve(cfg); err != nil {
@@ -139,6 +334,101 @@ func isFlagSet(name string) bool {
 }
 
 func Serve(cfg *Config) error {
+	handler := newHandler(cfg)
+
+	var tlsCfg *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsCfg, err = loadTLSConfig(cfg.TLS)
+		if err != nil {
+			return fmt.Errorf("TLS setup failed: %w", err)
+		}
+	}
+
+	addrs := cfg.Listen
+	if len(addrs) == 0 {
+		addrs = []string{cfg.Addr}
+	}
+	var plainAddrs, tlsAddrs []string
+	switch {
+	case cfg.TLS == nil:
+		plainAddrs = addrs
+	case cfg.TLS.Addr == "":
+		tlsAddrs = addrs
+	default:
+		// HTTPS on its own port, with plain HTTP either served normally or
+		// redirected to it.
+		plainAddrs, tlsAddrs = addrs, []string{cfg.TLS.Addr}
+	}
+
+	plainLns, err := openListeners(plainAddrs, cfg.PortAuto)
+	if err != nil {
+		return err
+	}
+	tlsLns, err := openListeners(tlsAddrs, cfg.PortAuto)
+	if err != nil {
+		closeListeners(plainLns)
+		return err
+	}
+
+	var runs []func() error
+	var infos []ListenInfo
+	if len(plainLns) > 0 {
+		svr := newServer(cfg, handler)
+		// Plain HTTP can't check client certificates, so with a client CA
+		// it only ever redirects.
+		redirect := cfg.TLS != nil && (cfg.TLS.RedirectHTTP || cfg.TLS.ClientCA != "")
+		if redirect {
+			svr.Handler = httpsRedirect(tlsLns[0].Addr().String())
+		}
+		for _, ln := range plainLns {
+			info := newListenInfo("http", ln.Addr())
+			info.Redirect = redirect
+			infos = append(infos, info)
+			runs = append(runs, func() error { return svr.Serve(ln) })
+		}
+	}
+	if len(tlsLns) > 0 {
+		tlsSvr := newServer(cfg, handler)
+		tlsSvr.TLSConfig = tlsCfg
+		var h3Infos []ListenInfo
+		if cfg.TLS.HTTP3 {
+			h3 := newHTTP3Server(cfg, handler, tlsCfg)
+			tlsSvr.Handler = altSvcMiddleware(handler, h3)
+			for _, ln := range tlsLns {
+				// QUIC needs a UDP port; unix sockets only get HTTP/1.1 and HTTP/2.
+				if ln.Addr().Network() != "tcp" {
+					continue
+				}
+				conn, err := net.ListenPacket("udp", ln.Addr().String())
+				if err != nil {
+					closeListeners(append(plainLns, tlsLns...))
+					return fmt.Errorf("HTTP/3 listen: %w", err)
+				}
+				h3Infos = append(h3Infos, newListenInfo("https", conn.LocalAddr()))
+				runs = append(runs, func() error { return h3.Serve(conn) })
+			}
+		}
+		for _, ln := range tlsLns {
+			infos = append(infos, newListenInfo("https", ln.Addr()))
+			runs = append(runs, func() error { return tlsSvr.ServeTLS(ln, "", "") })
+		}
+		infos = append(infos, h3Infos...)
+	}
+
+	if cfg.Ready != nil {
+		cfg.Ready(infos)
+	}
+
+	errc := make(chan error, len(runs))
+	for _, run := range runs {
+		go func() { errc <- run() }()
+	}
+	return <-errc
+}
+
+// newHandler builds the request handler shared by every listener.
+func newHandler(cfg *Config) http.Handler {
 	mux := http.NewServeMux()
 
 	if cfg.LiveReload != nil {
@@ -147,24 +437,38 @@ func Serve(cfg *Config) error {
 
 	uploadEnabled := cfg.Upload != nil
 	if uploadEnabled {
-		mux.Handle("/__upload", uploadHandler(cfg.Upload.Dir, cfg.Upload.MaxBytes))
+		mux.Handle("/__upload", uploadPermission(uploadHandler(cfg.Upload), cfg.Upload.Users))
+		mux.Handle("/__upload/", uploadPermission(uploadPutHandler(cfg.Upload), cfg.Upload.Users))
+		tus := uploadPermission(tusHandler(cfg.Upload), cfg.Upload.Users)
+		mux.Handle("/__tus", tus)
+		mux.Handle("/__tus/", tus)
 	}
 
-	if cfg.Zip {
-		mux.Handle("/__zip", zipHandler("."))
+	vis := newVisibility(cfg.Dotfiles, cfg.Deny)
+
+	if cfg.Zip != nil {
+		mux.Handle("/__zip", zipHandler(".", cfg.Zip, vis))
 	}
 
-	if cfg.WebUI {
-		mux.Handle("/__browse/", http.StripPrefix("/__browse", uiHandler(".", uploadEnabled, cfg.Zip, cfg.Dotfiles)))
+	if cfg.Manage {
+		mux.Handle("/__manage/", manageHandler(".", vis, cfg.ManageUsers))
 	}
 
-	var fs http.Handler
-	if cfg.Dotfiles {
-		fs = http.FileServer(http.Dir("."))
-	} else {
-		fs = hideRootDotfiles(http.FileServer(dotfileHidingFS{http.Dir(".")}))
+	if cfg.WebDAV {
+		var dav http.Handler = webdavHandler(".", cfg.Upload, cfg.WebDAVReadOnly, vis)
+		if creds != nil {
+			dav = BASICAUTH(dav)
+		}
+		mux.Handle("/__dav/", dav)
 	}
 
+	if cfg.WebUI {
+		opts := uiOptions{Upload: uploadEnabled, Zip: cfg.Zip != nil, Manage: cfg.Manage, Hide: vis}
+		mux.Handle("/__browse/", http.StripPrefix("/__browse", uiHandler(".", opts)))
+	}
+
+	fs := hideMiddleware(http.FileServer(visibleFS{http.Dir("."), vis}), vis, ".")
+
 	if creds != nil {
 		fs = BASICAUTH(fs)
 	}
@@ -183,82 +487,56 @@ func Serve(cfg *Config) error {
 
 	mux.Handle("/", fs)
 
-	svr := &http.Server{
-		Addr:           cfg.Addr,
-		Handler:        mux,
+	var handler http.Handler = mux
+	if cfg.AccessLog {
+		handler = accessLogMiddleware(handler)
+	}
+	return handler
+}
+
+func newServer(cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:        handler,
 		ReadTimeout:    cfg.Timeout,
 		WriteTimeout:   cfg.Timeout * 2,
 		IdleTimeout:    cfg.Timeout * 10,
 		MaxHeaderBytes: 1 << 20,
 	}
-
-	if cfg.TLS != nil {
-		cert, key := cfg.TLS.Cert, cfg.TLS.Key
-		if cert == "" || key == "" {
-			var err error
-			cert, key, err = loadOrGenerateCert()
-			if err != nil {
-				return fmt.Errorf("TLS setup failed: %w", err)
-			}
-		}
-		return svr.ListenAndServeTLS(cert, key)
-	}
-	return svr.ListenAndServe()
 }
 
-func BASICAUTH(next http.Handler) http.Handler {
+// httpsRedirect permanently redirects plain HTTP requests to the same host
+// and path on the HTTPS listener. 308 keeps the method and body, so uploads
+// are redirected too.
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !validBasicAuth(r) {
-			w.Header().Set("WWW-Authenticate", `Basic realm="dserve Basic Authentication"`)
-			http.Error(w, "Not Authorized", http.StatusUnauthorized)
-			return
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
 		}
-		next.ServeHTTP(w, r)
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host += ":" + tlsPort
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
 	})
 }
 
-func hideRootDotfiles(next http.Handler) http.Handler {
+// BASICAUTH requires valid basic auth credentials, unless the client already
+// presented a certificate verified against -tls-client-ca.
+func BASICAUTH(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/.") {
-			http.Error(w, "access to dotfiles in root directory is forbidden", http.StatusForbidden)
+		if verifiedClientCert(r) == nil && !validBasicAuth(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dserve Basic Authentication"`)
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-// dotfileHidingFS wraps http.FileSystem to hide dotfiles from root directory listings
-type dotfileHidingFS struct {
-	fs http.FileSystem
-}
-
-func (dfs dotfileHidingFS) Open(name string) (http.File, error) {
-	f, err := dfs.fs.Open(name)
-	if err != nil {
-		return nil, err
-	}
-	return dotfileHidingFile{f, name == "/" || name == ""}, nil
-}
-
-type dotfileHidingFile struct {
-	http.File
-	isRoot bool
-}
-
-func (f dotfileHidingFile) Readdir(n int) ([]os.FileInfo, error) {
-	files, err := f.File.Readdir(n)
-	if err != nil || !f.isRoot {
-		return files, err
-	}
-	filtered := files[:0]
-	for _, fi := range files {
-		if !strings.HasPrefix(fi.Name(), ".") {
-			filtered = append(filtered, fi)
-		}
-	}
-	return filtered, nil
-}
-
 type AuthCreds struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
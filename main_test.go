@@ -3,9 +3,14 @@ package main
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var fakeFSHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "fs") })
@@ -143,10 +148,21 @@ func TestBASICAUTH(t *testing.T) {
 			t.Errorf("expected body 'fs', got %q", rec.Body.String())
 		}
 	})
+
+	t.Run("allows verified client certificate", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = withClientCert("ci-runner")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", rec.Code)
+		}
+	})
 }
 
 func TestHideRootDotfiles(t *testing.T) {
-	handler := hideRootDotfiles(fakeFSHandler)
+	handler := hideMiddleware(fakeFSHandler, nil, t.TempDir())
 
 	tests := []struct {
 		path       string
@@ -172,3 +188,109 @@ func TestHideRootDotfiles(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		tlsAddr string
+		host    string
+		target  string
+		want    string
+	}{
+		{":9443", "example.com:9011", "/a/b?c=1", "https://example.com:9443/a/b?c=1"},
+		{":443", "example.com:80", "/", "https://example.com/"},
+		{"localhost:9443", "localhost", "/x", "https://localhost:9443/x"},
+		{":9443", "[::1]:9011", "/", "https://[::1]:9443/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.target, nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			httpsRedirect(tt.tlsAddr).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Errorf("expected 308, got %d", rec.Code)
+			}
+			if loc := rec.Header().Get("Location"); loc != tt.want {
+				t.Errorf("expected Location %q, got %q", tt.want, loc)
+			}
+		})
+	}
+}
+
+func TestServeClientCAPlainHTTP(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+	t.Chdir(dir)
+
+	certPEM, _, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	_ = os.WriteFile(caFile, certPEM, 0644)
+
+	ready := make(chan []ListenInfo, 1)
+	cfg := &Config{
+		Addr:    "127.0.0.1:0",
+		Timeout: time.Minute,
+		TLS:     &TLSConfig{ClientCA: caFile, Addr: "127.0.0.1:0"},
+		Ready:   func(infos []ListenInfo) { ready <- infos },
+	}
+	go func() { _ = Serve(cfg) }()
+
+	var infos []ListenInfo
+	select {
+	case infos = <-ready:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not report its listeners")
+	}
+	if infos[0].Scheme != "http" || !infos[0].Redirect {
+		t.Fatalf("plain HTTP should redirect with a client CA, got %+v", infos[0])
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(infos[0].URLs[0] + "/secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPermanentRedirect || string(body) == "secret" {
+		t.Errorf("plain GET without a certificate = %d %q, want a 308", resp.StatusCode, body)
+	}
+}
+
+func TestServeReady(t *testing.T) {
+	ready := make(chan []ListenInfo, 1)
+	cfg := &Config{
+		Addr:    "127.0.0.1:0",
+		Timeout: time.Minute,
+		Ready:   func(infos []ListenInfo) { ready <- infos },
+	}
+	go func() { _ = Serve(cfg) }()
+
+	var infos []ListenInfo
+	select {
+	case infos = <-ready:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not report its listeners")
+	}
+
+	if len(infos) != 1 || infos[0].Scheme != "http" || len(infos[0].URLs) != 1 {
+		t.Fatalf("unexpected listeners %+v", infos)
+	}
+	if strings.HasSuffix(infos[0].Address, ":0") {
+		t.Errorf("expected the bound port, got %s", infos[0].Address)
+	}
+
+	resp, err := http.Get(infos[0].URLs[0] + "/")
+	if err != nil {
+		t.Fatalf("request to bound URL failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
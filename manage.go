@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// File management endpoints (-manage), all POST with a JSON body:
+//
+//	/__manage/delete  {"path": "/old.txt"}
+//	/__manage/rename  {"from": "/a.txt", "to": "/docs/b.txt"}
+//	/__manage/mkdir   {"path": "/docs/new"}
+//
+// Rename doubles as move. Every path goes through resolvePath, so nothing
+// outside the served directory can be touched.
+
+type manageRequest struct {
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type manageResponse struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type manageError struct {
+	status int
+	msg    string
+}
+
+func (e *manageError) Error() string { return e.msg }
+
+// manageHandler serves the endpoints to identities in users (-upload-users),
+// or to anyone authenticated when users is empty.
+func manageHandler(rootDir string, hide *visibility, users []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user := requestIdentity(r)
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dserve Basic Authentication"`)
+			writeManageError(w, &manageError{http.StatusUnauthorized, "authentication required"})
+			return
+		}
+		if len(users) > 0 && !slices.Contains(users, user) {
+			writeManageError(w, &manageError{http.StatusForbidden, "file management not permitted for " + user})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeManageError(w, &manageError{http.StatusMethodNotAllowed, "method not allowed"})
+			return
+		}
+		// Requiring JSON forces a CORS preflight, so other sites cannot
+		// drive these endpoints with a logged-in browser.
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeManageError(w, &manageError{http.StatusUnsupportedMediaType, "expected application/json"})
+			return
+		}
+
+		var req manageRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFieldBytes)).Decode(&req); err != nil {
+			writeManageError(w, &manageError{http.StatusBadRequest, "invalid JSON body"})
+			return
+		}
+
+		m := manager{root: rootDir, hide: hide}
+		var result string
+		var err error
+		switch strings.TrimPrefix(r.URL.Path, "/__manage/") {
+		case "delete":
+			result, err = m.delete(req.Path)
+		case "rename":
+			result, err = m.rename(req.From, req.To)
+		case "mkdir":
+			result, err = m.mkdir(req.Path)
+		default:
+			err = &manageError{http.StatusNotFound, "unknown operation"}
+		}
+		if err != nil {
+			writeManageError(w, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(manageResponse{Success: true, Path: result})
+	})
+}
+
+func writeManageError(w http.ResponseWriter, err error) {
+	me, ok := err.(*manageError)
+	if !ok {
+		me = &manageError{http.StatusInternalServerError, err.Error()}
+	}
+	w.WriteHeader(me.status)
+	_ = json.NewEncoder(w).Encode(manageResponse{Error: me.msg})
+}
+
+type manager struct {
+	root string
+	hide *visibility
+}
+
+// resolve checks reqPath the same way as the zip handler, refuses the root
+// itself and hidden paths, and makes sure no symlinked parent
+// leads outside the root. For a parent that doesn't exist yet, its
+// deepest existing ancestor is checked, since mkdir creates the rest
+// under it.
+func (m manager) resolve(reqPath string) (string, string, error) {
+	abs, rel, err := resolvePath(m.root, reqPath)
+	if err == errOutsideRoot {
+		return "", "", &manageError{http.StatusForbidden, "forbidden"}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if rel == "" {
+		return "", "", &manageError{http.StatusBadRequest, "cannot change the root directory"}
+	}
+	if m.hide.hiddenPath(m.root, rel) {
+		return "", "", &manageError{http.StatusForbidden, "forbidden"}
+	}
+
+	dir := filepath.Dir(abs)
+	parent, err := filepath.EvalSymlinks(dir)
+	for err != nil && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		parent, err = filepath.EvalSymlinks(dir)
+	}
+	realRoot, _ := filepath.Abs(m.root)
+	realRoot, _ = filepath.EvalSymlinks(realRoot)
+	if err != nil || !withinDir(realRoot, parent) {
+		return "", "", &manageError{http.StatusForbidden, "forbidden"}
+	}
+	return abs, rel, nil
+}
+
+// checkName makes sure a new name survives safeFilename unchanged, so
+// rename and mkdir cannot create names uploads would refuse.
+func checkName(rel string) error {
+	name := path.Base(rel)
+	if safeFilename(name) != name {
+		return &manageError{http.StatusBadRequest, "invalid name: " + name}
+	}
+	return nil
+}
+
+func (m manager) delete(reqPath string) (string, error) {
+	abs, rel, err := m.resolve(reqPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(abs); errors.Is(err, fs.ErrNotExist) {
+		return "", &manageError{http.StatusNotFound, "not found"}
+	}
+	if err := os.RemoveAll(abs); err != nil {
+		return "", &manageError{http.StatusInternalServerError, "failed to delete"}
+	}
+	return "/" + rel, nil
+}
+
+func (m manager) rename(from, to string) (string, error) {
+	src, srcRel, err := m.resolve(from)
+	if err != nil {
+		return "", err
+	}
+	dst, dstRel, err := m.resolve(to)
+	if err != nil {
+		return "", err
+	}
+	if err := checkName(dstRel); err != nil {
+		return "", err
+	}
+	srcInfo, err := os.Lstat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", &manageError{http.StatusNotFound, "not found"}
+	}
+	if err == nil && m.hide.hidden(dstRel, srcInfo.IsDir()) {
+		return "", &manageError{http.StatusForbidden, "forbidden"}
+	}
+	if dstRel == srcRel || strings.HasPrefix(dstRel, srcRel+"/") {
+		return "", &manageError{http.StatusBadRequest, "cannot move a directory into itself"}
+	}
+	if fi, err := os.Stat(filepath.Dir(dst)); err != nil || !fi.IsDir() {
+		return "", &manageError{http.StatusNotFound, "target directory not found"}
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "", &manageError{http.StatusConflict, "target already exists"}
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return "", &manageError{http.StatusInternalServerError, "failed to rename"}
+	}
+	return "/" + dstRel, nil
+}
+
+func (m manager) mkdir(reqPath string) (string, error) {
+	abs, rel, err := m.resolve(reqPath)
+	if err != nil {
+		return "", err
+	}
+	for _, seg := range strings.Split(rel, "/") {
+		if err := checkName(seg); err != nil {
+			return "", err
+		}
+	}
+	if m.hide.hidden(rel, true) {
+		return "", &manageError{http.StatusForbidden, "forbidden"}
+	}
+	if fi, err := os.Stat(abs); err == nil {
+		if fi.IsDir() {
+			return "", &manageError{http.StatusConflict, "directory already exists"}
+		}
+		return "", &manageError{http.StatusConflict, "a file with that name exists"}
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return "", &manageError{http.StatusInternalServerError, "failed to create directory"}
+	}
+	return "/" + rel, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func manageRequestTo(op, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/__manage/"+op, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.TLS = withClientCert("admin")
+	return req
+}
+
+func TestManageHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		op         string
+		body       string
+		dotfiles   bool
+		wantStatus int
+		exists     []string
+		missing    []string
+	}{
+		{"delete file", "delete", `{"path":"/a.txt"}`, false, http.StatusOK, nil, []string{"a.txt"}},
+		{"delete directory", "delete", `{"path":"/docs"}`, false, http.StatusOK, nil, []string{"docs"}},
+		{"delete missing", "delete", `{"path":"/nope.txt"}`, false, http.StatusNotFound, nil, nil},
+		{"delete root refused", "delete", `{"path":"/"}`, false, http.StatusBadRequest, []string{"a.txt"}, nil},
+		{"delete traversal stays in root", "delete", `{"path":"../../a.txt"}`, false, http.StatusOK, nil, []string{"a.txt"}},
+		{"delete hidden dotfile", "delete", `{"path":"/.env"}`, false, http.StatusForbidden, []string{".env"}, nil},
+		{"delete dotfile with -dotfiles", "delete", `{"path":"/.env"}`, true, http.StatusOK, nil, []string{".env"}},
+		{"rename", "rename", `{"from":"/a.txt","to":"/b.txt"}`, false, http.StatusOK, []string{"b.txt"}, []string{"a.txt"}},
+		{"move into directory", "rename", `{"from":"/a.txt","to":"/docs/a.txt"}`, false, http.StatusOK, []string{"docs/a.txt"}, []string{"a.txt"}},
+		{"rename onto existing", "rename", `{"from":"/a.txt","to":"/docs/readme.md"}`, false, http.StatusConflict, []string{"a.txt"}, nil},
+		{"rename into missing directory", "rename", `{"from":"/a.txt","to":"/nope/a.txt"}`, false, http.StatusNotFound, []string{"a.txt"}, nil},
+		{"rename to invalid name", "rename", `{"from":"/a.txt","to":"/a?.txt"}`, false, http.StatusBadRequest, []string{"a.txt"}, nil},
+		{"move directory into itself", "rename", `{"from":"/docs","to":"/docs/inner"}`, false, http.StatusBadRequest, []string{"docs"}, nil},
+		{"rename to dotfile", "rename", `{"from":"/a.txt","to":"/.a.txt"}`, false, http.StatusForbidden, []string{"a.txt"}, nil},
+		{"mkdir", "mkdir", `{"path":"/new/deep"}`, false, http.StatusOK, []string{"new/deep"}, nil},
+		{"mkdir existing directory", "mkdir", `{"path":"/docs"}`, false, http.StatusConflict, nil, nil},
+		{"mkdir over file", "mkdir", `{"path":"/a.txt"}`, false, http.StatusConflict, nil, nil},
+		{"mkdir invalid name", "mkdir", `{"path":"/bad|name"}`, false, http.StatusBadRequest, nil, []string{"bad|name"}},
+		{"unknown operation", "chmod", `{"path":"/a.txt"}`, false, http.StatusNotFound, nil, nil},
+		{"invalid JSON", "delete", `{`, false, http.StatusBadRequest, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+			_ = os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+			_ = os.Mkdir(filepath.Join(dir, "docs"), 0755)
+			_ = os.WriteFile(filepath.Join(dir, "docs", "readme.md"), []byte("r"), 0644)
+
+			rec := httptest.NewRecorder()
+			manageHandler(dir, newVisibility(tt.dotfiles, nil), nil).ServeHTTP(rec, manageRequestTo(tt.op, tt.body))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			var resp manageResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid JSON response: %v", err)
+			}
+			if resp.Success != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("success = %v, error = %q", resp.Success, resp.Error)
+			}
+			for _, name := range tt.exists {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s should exist: %v", name, err)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					t.Errorf("%s should not exist", name)
+				}
+			}
+		})
+	}
+}
+
+func TestManageHandlerRequiresAuth(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	req := manageRequestTo("delete", `{"path":"/a.txt"}`)
+	req.TLS = nil
+	rec := httptest.NewRecorder()
+	manageHandler(dir, nil, nil).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("missing WWW-Authenticate header")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Error("file deleted without authentication")
+	}
+}
+
+func TestManageHandlerUsers(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	handler := manageHandler(dir, nil, []string{"alice"})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, manageRequestTo("delete", `{"path":"/a.txt"}`))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("admin: status = %d, want 403", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal("file deleted by an identity outside -upload-users")
+	}
+
+	req := manageRequestTo("delete", `{"path":"/a.txt"}`)
+	req.TLS = withClientCert("alice")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("alice: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestManageHandlerRejectsNonJSON(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		wantStatus  int
+	}{
+		{"GET", "GET", "application/json", http.StatusMethodNotAllowed},
+		{"form post", "POST", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"text post", "POST", "text/plain", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := manageRequestTo("delete", `{"path":"/a.txt"}`)
+			req.Method = tt.method
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			manageHandler(dir, nil, nil).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Error("file should not have been deleted")
+	}
+}
+
+func TestManageHandlerSymlinkedParent(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(outside, "victim.txt"), []byte("v"), 0644)
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	manageHandler(dir, nil, nil).ServeHTTP(rec, manageRequestTo("delete", `{"path":"/link/victim.txt"}`))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim.txt")); err != nil {
+		t.Error("file outside the root was deleted")
+	}
+
+	rec = httptest.NewRecorder()
+	manageHandler(dir, nil, nil).ServeHTTP(rec, manageRequestTo("mkdir", `{"path":"/link/a/b"}`))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("nested mkdir status = %d, want 403", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a")); err == nil {
+		t.Error("mkdir created a directory outside the root")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path is outside the served directory")
+
+// resolvePath maps a URL-style path such as "/docs/a.txt" to a filesystem
+// path under rootDir. It returns the absolute path and the cleaned
+// slash-separated path relative to the root ("" for the root itself), or
+// errOutsideRoot if the result would escape rootDir.
+func resolvePath(rootDir, reqPath string) (absPath, relPath string, err error) {
+	// Normalize URL path to prevent directory traversal
+	cleanURLPath := path.Clean("/" + reqPath)
+	relPath = strings.TrimPrefix(cleanURLPath, "/")
+
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return "", "", err
+	}
+	absPath = filepath.Join(absRoot, filepath.FromSlash(relPath))
+
+	// Validate path is within root using filepath.Rel
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", "", errOutsideRoot
+	}
+	return absPath, relPath, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	root := t.TempDir()
+
+	tests := []struct {
+		req     string
+		wantRel string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"docs/a.txt", "docs/a.txt"},
+		{"/docs/./a.txt", "docs/a.txt"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"/docs/../../a.txt", "a.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.req, func(t *testing.T) {
+			abs, rel, err := resolvePath(root, tt.req)
+			if err != nil {
+				t.Fatalf("resolvePath(%q): %v", tt.req, err)
+			}
+			if rel != tt.wantRel {
+				t.Errorf("rel = %q, want %q", rel, tt.wantRel)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.wantRel)); abs != want {
+				t.Errorf("abs = %q, want %q", abs, want)
+			}
+		})
+	}
+}
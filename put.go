@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// uploadPutHandler accepts raw uploads for scripts:
+//
+//	curl -T build.tar.gz https://host/__upload/releases/build.tar.gz
+//
+// The body is streamed to the path after /__upload/ with the same checks
+// and response as multipart uploads.
+func uploadPutHandler(cfg *UploadConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			writeUploadError(w, &uploadError{http.StatusMethodNotAllowed, "method not allowed"})
+			return
+		}
+
+		relPath := safeRelPath(strings.TrimPrefix(r.URL.Path, "/__upload/"))
+		if relPath == "" {
+			writeUploadError(w, &uploadError{http.StatusBadRequest, "invalid path"})
+			return
+		}
+		if r.ContentLength > cfg.MaxBytes {
+			writeUploadError(w, errBodyTooLarge)
+			return
+		}
+
+		policy, uerr := conflictPolicy(r.URL.Query().Get("conflict"), cfg.Conflict)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		// If-None-Match: * asks for create-only semantics.
+		createOnly := strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+		if createOnly {
+			policy = conflictReject
+		}
+
+		// Directories are only created once the file is placed, so a
+		// refused upload leaves nothing behind.
+		dest, uerr := uploadPath(cfg, "", relPath)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		_, statErr := os.Lstat(dest)
+		exists := statErr == nil
+		if exists && createOnly {
+			writeUploadError(w, &uploadError{http.StatusPreconditionFailed, "file already exists"})
+			return
+		}
+
+		digests, uerr := requestDigests(r.Header)
+		if uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes)
+		user := requestIdentity(r)
+		f, fatal := receiveFile(cfg, cfg.Dir, relPath, user, 0, r.Body)
+		if fatal != nil {
+			writeUploadError(w, fatal)
+			return
+		}
+		defer func() {
+			if f.tmp != "" {
+				os.Remove(f.tmp)
+			}
+		}()
+
+		if f.err == nil {
+			f.err = verifyDigests(digests, f)
+		}
+		if f.err == nil {
+			f.err = f.commit(cfg, "", policy)
+		}
+		if f.err != nil {
+			if createOnly && f.err.status == http.StatusConflict {
+				f.err = &uploadError{http.StatusPreconditionFailed, "file already exists"}
+			}
+			writeUploadError(w, f.err)
+			return
+		}
+		if !f.skipped && countsUsage(cfg) {
+			usageFor(cfg.Dir).add(user, f.size)
+		}
+
+		res := f.result(cfg.Dir)
+		if !f.skipped {
+			fireUploadHooks(cfg, newUploadEvent(res, user))
+		}
+		if !exists || res.Path != relPath {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(uploadResponse{
+			Success:  true,
+			Filename: res.Filename,
+			Size:     res.Size,
+			SHA256:   res.SHA256,
+			Files:    []uploadResult{res},
+		})
+	})
+}
+
+// requestDigests collects the checksums a PUT request declares, as
+// lowercase hex keyed by algorithm ("md5", "sha-256"). It reads
+// Content-MD5 and the RFC 3230 Digest header; other algorithms are
+// ignored.
+func requestDigests(h http.Header) (map[string]string, *uploadError) {
+	digests := map[string]string{}
+	add := func(alg, b64 string) *uploadError {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return &uploadError{http.StatusBadRequest, "invalid " + alg + " digest"}
+		}
+		digests[alg] = hex.EncodeToString(raw)
+		return nil
+	}
+
+	if v := h.Get("Content-MD5"); v != "" {
+		if err := add("md5", v); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range strings.Split(h.Get("Digest"), ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		if alg = strings.ToLower(alg); alg == "md5" || alg == "sha-256" {
+			if err := add(alg, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return digests, nil
+}
+
+func verifyDigests(digests map[string]string, f *stagedFile) *uploadError {
+	if err := verifyChecksum(digests["md5"], f.md5); err != nil {
+		return err
+	}
+	return verifyChecksum(digests["sha-256"], f.sha256)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadPutHandler(t *testing.T) {
+	md5sum := func(s string) string {
+		h := md5.Sum([]byte(s))
+		return base64.StdEncoding.EncodeToString(h[:])
+	}
+	shasum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return base64.StdEncoding.EncodeToString(h[:])
+	}
+
+	tests := []struct {
+		name       string
+		cfg        UploadConfig
+		method     string
+		target     string
+		body       string
+		headers    map[string]string
+		existing   string // content of releases/build.tar.gz before the request
+		wantStatus int
+		wantError  string
+		wantPath   string // file expected to hold body afterwards
+	}{
+		{
+			name: "create", method: http.MethodPut, target: "/__upload/releases/build.tar.gz", body: "payload",
+			wantStatus: http.StatusCreated, wantPath: "releases/build.tar.gz",
+		},
+		{
+			name: "existing file renamed by default", method: http.MethodPut, target: "/__upload/releases/build.tar.gz", body: "payload",
+			existing: "old", wantStatus: http.StatusCreated, wantPath: "releases/build.tar_1.gz",
+		},
+		{
+			name: "overwrite", method: http.MethodPut, target: "/__upload/releases/build.tar.gz?conflict=overwrite", body: "payload",
+			existing: "old", wantStatus: http.StatusOK, wantPath: "releases/build.tar.gz",
+		},
+		{
+			name: "if-none-match on new file", method: http.MethodPut, target: "/__upload/releases/build.tar.gz", body: "payload",
+			headers: map[string]string{"If-None-Match": "*"}, wantStatus: http.StatusCreated, wantPath: "releases/build.tar.gz",
+		},
+		{
+			name: "if-none-match on existing file", cfg: UploadConfig{Conflict: conflictOverwrite}, method: http.MethodPut,
+			target: "/__upload/releases/build.tar.gz", body: "payload", headers: map[string]string{"If-None-Match": "*"},
+			existing: "old", wantStatus: http.StatusPreconditionFailed, wantError: "file already exists",
+		},
+		{
+			name: "content-md5 ok", method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			headers: map[string]string{"Content-MD5": md5sum("payload")}, wantStatus: http.StatusCreated, wantPath: "a.txt",
+		},
+		{
+			name: "content-md5 mismatch", method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			headers: map[string]string{"Content-MD5": md5sum("other")}, wantStatus: http.StatusUnprocessableEntity, wantError: "checksum mismatch",
+		},
+		{
+			name: "digest ok", method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			headers: map[string]string{"Digest": "SHA-256=" + shasum("payload") + ", unixsum=30637"}, wantStatus: http.StatusCreated, wantPath: "a.txt",
+		},
+		{
+			name: "digest mismatch", method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			headers: map[string]string{"Digest": "sha-256=" + shasum("other")}, wantStatus: http.StatusUnprocessableEntity, wantError: "checksum mismatch",
+		},
+		{
+			name: "refused upload creates no directories", cfg: UploadConfig{DenyExt: []string{".sh"}}, method: http.MethodPut,
+			target: "/__upload/new/scripts/run.sh", body: "echo", wantStatus: http.StatusUnsupportedMediaType, wantError: "file type not allowed: .sh",
+		},
+		{
+			name: "hidden file", cfg: UploadConfig{Hide: newVisibility(false, []string{"*.key"})}, method: http.MethodPut,
+			target: "/__upload/certs/server.key", body: "key", wantStatus: http.StatusForbidden, wantError: "hidden path not allowed",
+		},
+		{
+			name: "hidden directory", cfg: UploadConfig{Hide: newVisibility(false, []string{"node_modules/"})}, method: http.MethodPut,
+			target: "/__upload/web/node_modules/pkg/index.js", body: "x", wantStatus: http.StatusForbidden, wantError: "hidden path not allowed",
+		},
+		{
+			name: "bad digest encoding", method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			headers: map[string]string{"Content-MD5": "not base64!"}, wantStatus: http.StatusBadRequest, wantError: "invalid md5 digest",
+		},
+		{
+			name: "too large", cfg: UploadConfig{MaxBytes: 4}, method: http.MethodPut, target: "/__upload/a.txt", body: "payload",
+			wantStatus: http.StatusRequestEntityTooLarge, wantError: "file too large",
+		},
+		{
+			name: "denied extension", cfg: UploadConfig{DenyExt: []string{".sh"}}, method: http.MethodPut, target: "/__upload/run.sh", body: "echo",
+			wantStatus: http.StatusUnsupportedMediaType, wantError: "file type not allowed: .sh",
+		},
+		{
+			name: "traversal", method: http.MethodPut, target: "/__upload/../../etc/passwd", body: "payload",
+			wantStatus: http.StatusCreated, wantPath: "passwd",
+		},
+		{
+			name: "no path", method: http.MethodPut, target: "/__upload/", body: "payload",
+			wantStatus: http.StatusBadRequest, wantError: "invalid path",
+		},
+		{
+			name: "wrong method", method: http.MethodPost, target: "/__upload/a.txt", body: "payload",
+			wantStatus: http.StatusMethodNotAllowed, wantError: "method not allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing != "" {
+				_ = os.MkdirAll(filepath.Join(dir, "releases"), 0755)
+				_ = os.WriteFile(filepath.Join(dir, "releases", "build.tar.gz"), []byte(tt.existing), 0644)
+			}
+			cfg := tt.cfg
+			cfg.Dir = dir
+			if cfg.MaxBytes == 0 {
+				cfg.MaxBytes = 1024
+			}
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			// httptest keeps ".." in the URL; the mux would have cleaned it.
+			req.URL.Path = tt.target
+			if i := strings.IndexByte(tt.target, '?'); i >= 0 {
+				req.URL.Path = tt.target[:i]
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			uploadPutHandler(&cfg).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			var resp uploadResponse
+			_ = json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Error != tt.wantError {
+				t.Errorf("expected error %q, got %q", tt.wantError, resp.Error)
+			}
+			if tt.wantPath != "" {
+				if len(resp.Files) != 1 || resp.Files[0].Path != tt.wantPath || resp.Size != int64(len(tt.body)) || resp.SHA256 == "" {
+					t.Errorf("unexpected response: %+v", resp)
+				}
+				content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.wantPath)))
+				if err != nil || string(content) != tt.body {
+					t.Errorf("expected %s to hold the body, got %q (%v)", tt.wantPath, content, err)
+				}
+			}
+			if tt.wantPath == "" && tt.existing == "" {
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("failed upload left %v behind", entries)
+				}
+			}
+			if tt.existing != "" && tt.wantPath != "releases/build.tar.gz" {
+				if content, _ := os.ReadFile(filepath.Join(dir, "releases", "build.tar.gz")); string(content) != tt.existing {
+					t.Errorf("existing file changed to %q", content)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPutRoute(t *testing.T) {
+	dir := t.TempDir()
+	handler := newHandler(&Config{Upload: &UploadConfig{Dir: dir, MaxBytes: 1024}})
+
+	req := httptest.NewRequest(http.MethodPut, "/__upload/ci/report.txt", strings.NewReader("ok"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "ci", "report.txt")); string(content) != "ok" {
+		t.Errorf("expected file written through the mux, got %q", content)
+	}
+}
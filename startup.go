@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// ListenInfo describes a bound listener. Serve reports them through
+// Config.Ready once every socket is open.
+type ListenInfo struct {
+	Scheme   string   `json:"scheme"`  // http or https
+	Network  string   `json:"network"` // tcp, unix or udp (HTTP/3)
+	Address  string   `json:"address"`
+	URLs     []string `json:"urls,omitempty"`
+	Redirect bool     `json:"redirect,omitempty"` // plain HTTP redirecting to HTTPS
+}
+
+func newListenInfo(scheme string, addr net.Addr) ListenInfo {
+	info := ListenInfo{Scheme: scheme, Network: addr.Network(), Address: addr.String()}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		info.URLs = tcpURLs(scheme, a)
+	case *net.UnixAddr:
+		info.URLs = []string{"unix:" + a.Name}
+	}
+	return info
+}
+
+// tcpURLs lists the URLs a TCP listener is reachable at. Wildcard listeners
+// get localhost plus every LAN address, so other devices can connect.
+func tcpURLs(scheme string, a *net.TCPAddr) []string {
+	port := fmt.Sprint(a.Port)
+	if a.IP != nil && !a.IP.IsUnspecified() {
+		return []string{scheme + "://" + net.JoinHostPort(a.IP.String(), port)}
+	}
+	urls := []string{scheme + "://" + net.JoinHostPort("localhost", port)}
+	for _, ip := range getLocalIPs() {
+		urls = append(urls, scheme+"://"+net.JoinHostPort(ip.String(), port))
+	}
+	return urls
+}
+
+type startupInfo struct {
+	Dir       string       `json:"dir"`
+	Listeners []ListenInfo `json:"listeners"`
+}
+
+// writeStartupJSON emits the bound listeners as a single JSON line for
+// scripts and test harnesses (-json-startup).
+func writeStartupJSON(w io.Writer, dir string, infos []ListenInfo) error {
+	return json.NewEncoder(w).Encode(startupInfo{Dir: dir, Listeners: infos})
+}
+
+func writeStartupText(w io.Writer, dir string, infos []ListenInfo) {
+	for _, info := range infos {
+		if info.Network == "udp" {
+			fmt.Fprintf(w, "HTTP/3 enabled on udp %s\n", info.Address)
+			continue
+		}
+		if len(info.URLs) == 0 {
+			continue
+		}
+		if info.Redirect {
+			fmt.Fprintf(w, "Redirecting %s to HTTPS\n", info.URLs[0])
+		} else {
+			fmt.Fprintf(w, "Serving %s at %s\n", dir, info.URLs[0])
+		}
+		for _, u := range info.URLs[1:] {
+			fmt.Fprintf(w, "  also at %s\n", u)
+		}
+	}
+}
+
+// primaryURL picks the URL to show as the main address, preferring a
+// non-redirecting listener.
+func primaryURL(infos []ListenInfo) string {
+	for _, info := range infos {
+		if !info.Redirect && len(info.URLs) > 0 && info.Network == "tcp" {
+			return info.URLs[0]
+		}
+	}
+	return ""
+}
+
+// lanURL picks the first URL another device on the network could open.
+func lanURL(infos []ListenInfo) string {
+	for _, info := range infos {
+		if info.Redirect || info.Network != "tcp" {
+			continue
+		}
+		for _, u := range info.URLs {
+			if !strings.Contains(u, "://localhost:") && !strings.Contains(u, "://127.") && !strings.Contains(u, "://[::1]") {
+				return u
+			}
+		}
+	}
+	return ""
+}
+
+// qrText renders text as a QR code with half-block characters, two modules
+// per character row, so it fits in a terminal.
+func qrText(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+
+	const quiet = 2
+	black := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+	}
+
+	// Light modules are drawn as blocks so the code reads on dark terminals.
+	var b strings.Builder
+	size := code.Size + 2*quiet
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := !black(x, y), !black(x, y+1)
+			if y+1 >= size {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
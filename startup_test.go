@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewListenInfo(t *testing.T) {
+	t.Run("specific address", func(t *testing.T) {
+		info := newListenInfo("https", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9443})
+		if info.Network != "tcp" || info.Address != "127.0.0.1:9443" {
+			t.Errorf("unexpected info %+v", info)
+		}
+		if len(info.URLs) != 1 || info.URLs[0] != "https://127.0.0.1:9443" {
+			t.Errorf("unexpected URLs %v", info.URLs)
+		}
+	})
+
+	t.Run("wildcard address lists localhost and LAN IPs", func(t *testing.T) {
+		info := newListenInfo("http", &net.TCPAddr{IP: net.IPv6unspecified, Port: 9011})
+		if info.URLs[0] != "http://localhost:9011" {
+			t.Errorf("expected localhost first, got %v", info.URLs)
+		}
+		if want := 1 + len(getLocalIPs()); len(info.URLs) != want {
+			t.Errorf("expected %d URLs, got %v", want, info.URLs)
+		}
+	})
+
+	t.Run("IPv6 address", func(t *testing.T) {
+		info := newListenInfo("http", &net.TCPAddr{IP: net.IPv6loopback, Port: 9011})
+		if info.URLs[0] != "http://[::1]:9011" {
+			t.Errorf("unexpected URLs %v", info.URLs)
+		}
+	})
+
+	t.Run("unix socket", func(t *testing.T) {
+		info := newListenInfo("http", &net.UnixAddr{Name: "/run/dserve.sock", Net: "unix"})
+		if len(info.URLs) != 1 || info.URLs[0] != "unix:/run/dserve.sock" {
+			t.Errorf("unexpected URLs %v", info.URLs)
+		}
+	})
+}
+
+func TestWriteStartupJSON(t *testing.T) {
+	infos := []ListenInfo{
+		{Scheme: "http", Network: "tcp", Address: "127.0.0.1:9011", URLs: []string{"http://127.0.0.1:9011"}, Redirect: true},
+		{Scheme: "https", Network: "tcp", Address: "127.0.0.1:9443", URLs: []string{"https://127.0.0.1:9443"}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeStartupJSON(&buf, "./public", infos); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("expected exactly one line, got %q", buf.String())
+	}
+
+	var got startupInfo
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if got.Dir != "./public" || len(got.Listeners) != 2 || !got.Listeners[0].Redirect {
+		t.Errorf("unexpected startup info %+v", got)
+	}
+}
+
+func TestWriteStartupText(t *testing.T) {
+	infos := []ListenInfo{
+		{Scheme: "http", Network: "tcp", URLs: []string{"http://localhost:9011"}, Redirect: true},
+		{Scheme: "https", Network: "tcp", URLs: []string{"https://localhost:9443", "https://192.168.1.5:9443"}},
+		{Scheme: "https", Network: "udp", Address: "[::]:9443"},
+	}
+
+	var buf bytes.Buffer
+	writeStartupText(&buf, "./", infos)
+	out := buf.String()
+	for _, want := range []string{
+		"Redirecting http://localhost:9011 to HTTPS",
+		"Serving ./ at https://localhost:9443",
+		"also at https://192.168.1.5:9443",
+		"HTTP/3 enabled on udp [::]:9443",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	if got := primaryURL(infos); got != "https://localhost:9443" {
+		t.Errorf("primaryURL = %q", got)
+	}
+	if got := lanURL(infos); got != "https://192.168.1.5:9443" {
+		t.Errorf("lanURL = %q", got)
+	}
+}
+
+func TestQRText(t *testing.T) {
+	code, err := qrText("http://192.168.1.5:9011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(code, "\n"), "\n")
+	if len(lines) < 10 {
+		t.Fatalf("QR code too small: %d lines", len(lines))
+	}
+	width := len([]rune(lines[0]))
+	for i, line := range lines {
+		if n := len([]rune(line)); n != width {
+			t.Errorf("line %d has width %d, want %d", i, n, width)
+		}
+	}
+	// Two modules per row: height is roughly half the width.
+	if len(lines) > width/2+1 {
+		t.Errorf("expected half-height rendering, got %d lines for width %d", len(lines), width)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
@@ -119,3 +121,52 @@ func getLocalIPs() []net.IP {
 	}
 	return ips
 }
+
+// serverTLSConfig builds the tls.Config for Serve. When a client CA is set,
+// client certificates are requested and verified against it; in optional
+// mode clients without a certificate can still fall back to basic auth.
+func serverTLSConfig(tc *TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if tc.ClientCA == "" {
+		return cfg, nil
+	}
+
+	caPEM, err := os.ReadFile(tc.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in client CA file " + tc.ClientCA)
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if tc.ClientAuthOptional {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// loadTLSConfig returns the server tls.Config with the configured
+// certificate, or the auto-generated one, loaded.
+func loadTLSConfig(tc *TLSConfig) (*tls.Config, error) {
+	cfg, err := serverTLSConfig(tc)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, key := tc.Cert, tc.Key
+	if cert == "" || key == "" {
+		cert, key, err = loadOrGenerateCert()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = []tls.Certificate{pair}
+	return cfg, nil
+}
@@ -174,3 +174,59 @@ func TestCertPaths(t *testing.T) {
 		t.Errorf("unexpected key path: %s", keyPath)
 	}
 }
+
+func TestServerTLSConfig(t *testing.T) {
+	t.Run("no client CA", func(t *testing.T) {
+		cfg, err := serverTLSConfig(&TLSConfig{})
+		if err != nil {
+			t.Fatalf("serverTLSConfig failed: %v", err)
+		}
+		if cfg.ClientAuth != tls.NoClientCert {
+			t.Errorf("expected NoClientCert, got %v", cfg.ClientAuth)
+		}
+	})
+
+	certPEM, _, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert failed: %v", err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	_ = os.WriteFile(caFile, certPEM, 0644)
+
+	t.Run("required client certs", func(t *testing.T) {
+		cfg, err := serverTLSConfig(&TLSConfig{ClientCA: caFile})
+		if err != nil {
+			t.Fatalf("serverTLSConfig failed: %v", err)
+		}
+		if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+			t.Errorf("expected RequireAndVerifyClientCert, got %v", cfg.ClientAuth)
+		}
+		if cfg.ClientCAs == nil {
+			t.Error("expected ClientCAs pool")
+		}
+	})
+
+	t.Run("optional client certs", func(t *testing.T) {
+		cfg, err := serverTLSConfig(&TLSConfig{ClientCA: caFile, ClientAuthOptional: true})
+		if err != nil {
+			t.Fatalf("serverTLSConfig failed: %v", err)
+		}
+		if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+			t.Errorf("expected VerifyClientCertIfGiven, got %v", cfg.ClientAuth)
+		}
+	})
+
+	t.Run("missing CA file", func(t *testing.T) {
+		if _, err := serverTLSConfig(&TLSConfig{ClientCA: filepath.Join(t.TempDir(), "nope.pem")}); err == nil {
+			t.Error("expected error for missing CA file")
+		}
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "bad.pem")
+		_ = os.WriteFile(bad, []byte("not a cert"), 0644)
+		if _, err := serverTLSConfig(&TLSConfig{ClientCA: bad}); err == nil {
+			t.Error("expected error for CA file without certificates")
+		}
+	})
+}
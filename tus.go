@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus 1.0 resumable uploads (https://tus.io/protocols/resumable-upload).
+// Supported extensions: creation, expiration and termination.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusStagingDir = ".dserve-tus"
+	tusExpiry     = 24 * time.Hour
+	tusCleanEvery = time.Hour
+)
+
+var tusIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusInfo is the sidecar stored next to each partial upload. The current
+// offset is the size of the data file, so it survives restarts.
+type tusInfo struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+type tusStore struct {
+	upload  *UploadConfig
+	dir     string // staging directory under upload.Dir
+	expiry  time.Duration
+	mu      sync.Mutex
+	busy    map[string]bool // uploads with a PATCH in flight
+	cleaned time.Time
+}
+
+func newTusStore(cfg *UploadConfig) *tusStore {
+	s := &tusStore{
+		upload: cfg,
+		dir:    filepath.Join(cfg.Dir, tusStagingDir),
+		expiry: tusExpiry,
+		busy:   make(map[string]bool),
+	}
+	// Uploads left by an earlier run still hold their space.
+	if countsUsage(cfg) {
+		entries, _ := os.ReadDir(s.dir)
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), ".info")
+			if !ok || !tusIDRe.MatchString(id) {
+				continue
+			}
+			if info, _, err := s.load(id); err == nil {
+				usageFor(cfg.Dir).reserve(info.User, info.Length)
+			}
+		}
+	}
+	return s
+}
+
+func (s *tusStore) dataPath(id string) string { return filepath.Join(s.dir, id+".bin") }
+func (s *tusStore) infoPath(id string) string { return filepath.Join(s.dir, id+".info") }
+
+func (s *tusStore) load(id string) (*tusInfo, int64, error) {
+	b, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var info tusInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, 0, err
+	}
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &info, fi.Size(), nil
+}
+
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// discard removes an upload and gives back the quota reserved for it.
+func (s *tusStore) discard(info *tusInfo) {
+	s.remove(info.ID)
+	if countsUsage(s.upload) {
+		usageFor(s.upload.Dir).release(info.User, info.Length)
+	}
+}
+
+// cleanup removes abandoned partial uploads. It runs at most once per
+// tusCleanEvery, piggybacking on upload creation.
+func (s *tusStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.cleaned) < tusCleanEvery {
+		s.mu.Unlock()
+		return
+	}
+	s.cleaned = now
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".info")
+		if !ok || !tusIDRe.MatchString(id) {
+			continue
+		}
+		info, _, err := s.load(id)
+		switch {
+		case err != nil:
+			s.remove(id)
+		case now.After(info.Expires):
+			s.discard(info)
+		}
+	}
+}
+
+// lock marks an upload busy so concurrent PATCH requests cannot interleave.
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+func tusHandler(cfg *UploadConfig) http.Handler {
+	s := newTusStore(cfg)
+	return http.StripPrefix("/__tus", s)
+}
+
+func (s *tusStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.upload.MaxBytes, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(r.URL.Path, "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.create(w, r)
+		return
+	}
+	if !tusIDRe.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, offset, err := s.load(id)
+	// Only whoever created an upload may see, resume or end it; anyone
+	// else gets the same answer as for an unknown ID.
+	if err != nil || info.User != requestIdentity(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if time.Now().After(info.Expires) {
+		s.discard(info)
+		http.Error(w, "upload expired", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+		if len(info.Metadata) > 0 {
+			w.Header().Set("Upload-Metadata", encodeTusMetadata(info.Metadata))
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.patch(w, r, info, offset)
+	case http.MethodDelete:
+		if !s.lock(id) {
+			http.Error(w, "upload in progress", http.StatusConflict)
+			return
+		}
+		defer s.unlock(id)
+		s.discard(info)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *tusStore) create(w http.ResponseWriter, r *http.Request) {
+	s.cleanup(time.Now())
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > s.upload.MaxBytes {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if safeRelPath(meta["filename"]) == "" {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+	if uerr := checkExtension(s.upload, meta["filename"]); uerr != nil {
+		http.Error(w, uerr.msg, uerr.status)
+		return
+	}
+	if allowance, reason := uploadAllowance(s.upload, requestIdentity(r), 0); allowance >= 0 && length > allowance {
+		http.Error(w, reason.msg, reason.status)
+		return
+	}
+	policy, uerr := conflictPolicy(meta["conflict"], s.upload.Conflict)
+	if uerr != nil {
+		http.Error(w, uerr.msg, uerr.status)
+		return
+	}
+	// Refuse up front rather than after the client has sent every byte.
+	dest, uerr := uploadPath(s.upload, meta["path"], meta["filename"])
+	if uerr != nil {
+		http.Error(w, uerr.msg, uerr.status)
+		return
+	}
+	if policy == conflictReject {
+		if _, err := os.Lstat(dest); err == nil {
+			http.Error(w, "file already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	info := tusInfo{
+		ID:       hex.EncodeToString(raw[:]),
+		Length:   length,
+		Metadata: meta,
+		User:     requestIdentity(r),
+		Expires:  time.Now().Add(s.expiry),
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		http.Error(w, "failed to create staging directory", http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(info)
+	if err := os.WriteFile(s.infoPath(info.ID), b, 0644); err != nil {
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(s.dataPath(info.ID), nil, 0644); err != nil {
+		s.remove(info.ID)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	// Hold the space now, so uploads running side by side cannot together
+	// go over a quota that each of them fits.
+	if countsUsage(s.upload) {
+		usageFor(s.upload.Dir).reserve(info.User, length)
+	}
+
+	if length == 0 {
+		if _, err := s.finish(&info); err != nil {
+			http.Error(w, err.msg, err.status)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/__tus/"+info.ID)
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *tusStore) patch(w http.ResponseWriter, r *http.Request, info *tusInfo, offset int64) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if !s.lock(info.ID) {
+		http.Error(w, "upload in progress", http.StatusConflict)
+		return
+	}
+	defer s.unlock(info.ID)
+
+	// Re-read the offset now that we hold the lock.
+	if fi, err := os.Stat(s.dataPath(info.ID)); err == nil {
+		offset = fi.Size()
+	}
+	if clientOffset != offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(s.dataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, "failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, info.Length-offset)
+	n, copyErr := io.Copy(f, body)
+	closeErr := f.Close()
+	offset += n
+
+	// Bytes received before a dropped connection are kept, so the client
+	// can resume from the new offset.
+	info.Expires = time.Now().Add(s.expiry)
+	if b, err := json.Marshal(info); err == nil {
+		_ = os.WriteFile(s.infoPath(info.ID), b, 0644)
+	}
+
+	if copyErr != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(copyErr, &maxErr) {
+			http.Error(w, "data exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+	if closeErr != nil {
+		http.Error(w, "failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == info.Length {
+		if _, err := s.finish(info); err != nil {
+			http.Error(w, err.msg, err.status)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish moves a complete upload from the staging directory to its
+// destination, named the same way as regular uploads.
+func (s *tusStore) finish(info *tusInfo) (string, *uploadError) {
+	policy, uerr := conflictPolicy(info.Metadata["conflict"], s.upload.Conflict)
+	if uerr != nil {
+		return "", uerr
+	}
+	sum, uerr := s.verify(info)
+	if uerr != nil {
+		s.discard(info)
+		return "", uerr
+	}
+	destPath, uerr := uploadTarget(s.upload, info.Metadata["path"], info.Metadata["filename"])
+	if uerr != nil {
+		return "", uerr
+	}
+	final, skipped, uerr := placeUpload(s.dataPath(info.ID), destPath, policy, s.upload.Backup)
+	if uerr != nil && uerr.status != http.StatusConflict {
+		return "", uerr
+	}
+	// Skipped and rejected uploads have nowhere to go, so they are dropped.
+	s.discard(info)
+	if uerr == nil && !skipped {
+		if countsUsage(s.upload) {
+			usageFor(s.upload.Dir).add(info.User, info.Length)
+		}
+		if len(s.upload.Hooks) > 0 {
+			rel, _ := filepath.Rel(s.upload.Dir, final)
+			res := uploadResult{Filename: filepath.Base(final), Path: filepath.ToSlash(rel), Size: info.Length, SHA256: sum}
+			user := info.User
+			// Hashing a large file takes a while, and the client is
+			// waiting for the last PATCH to return.
+			go func() {
+				if res.SHA256 == "" {
+					res.SHA256, _ = fileSHA256(final)
+				}
+				fireUploadHooks(s.upload, newUploadEvent(res, user))
+			}()
+		}
+	}
+	return final, uerr
+}
+
+// verify runs the content checks that need the whole file: the sniffed
+// content type and the optional "sha256" metadata. It returns the file's
+// SHA-256 when it had to compute it.
+func (s *tusStore) verify(info *tusInfo) (string, *uploadError) {
+	head, err := sniffFile(s.dataPath(info.ID))
+	if err != nil {
+		return "", &uploadError{http.StatusInternalServerError, "failed to read upload"}
+	}
+	if uerr := checkContentType(s.upload, head); uerr != nil {
+		return "", uerr
+	}
+	if want := info.Metadata["sha256"]; want != "" {
+		got, err := fileSHA256(s.dataPath(info.ID))
+		if err != nil {
+			return "", &uploadError{http.StatusInternalServerError, "failed to read upload"}
+		}
+		return got, verifyChecksum(want, got)
+	}
+	return "", nil
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+func encodeTusMetadata(meta map[string]string) string {
+	var pairs []string
+	for _, k := range slices.Sorted(maps.Keys(meta)) {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(meta[k])))
+	}
+	return strings.Join(pairs, ",")
+}
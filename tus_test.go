@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusRequest(method, target, body string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func tusMeta(pairs ...string) string {
+	var out []string
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(out, ",")
+}
+
+func tusCreate(t *testing.T, handler http.Handler, length, meta string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": meta,
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	loc := rec.Header().Get("Location")
+	if !strings.HasPrefix(loc, "/__tus/") {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+	return loc
+}
+
+func tusPatch(handler http.Handler, loc, offset, chunk string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodPatch, loc, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	}))
+	return rec
+}
+
+func TestTusOptions(t *testing.T) {
+	handler := tusHandler(&UploadConfig{Dir: t.TempDir(), MaxBytes: 1024})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/__tus/", nil))
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Tus-Version"); got != "1.0.0" {
+		t.Errorf("expected Tus-Version 1.0.0, got %q", got)
+	}
+	if got := rec.Header().Get("Tus-Max-Size"); got != "1024" {
+		t.Errorf("expected Tus-Max-Size 1024, got %q", got)
+	}
+	if !strings.Contains(rec.Header().Get("Tus-Extension"), "creation") {
+		t.Error("expected creation extension")
+	}
+}
+
+func TestTusResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024})
+
+	loc := tusCreate(t, handler, "11", tusMeta("filename", "big.bin", "path", "sub"))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodHead, loc, "", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "0" || rec.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("HEAD: got %d offset=%q length=%q", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	rec = tusPatch(handler, loc, "0", "hello")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first PATCH: got %d offset=%q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	// Partial data lives in the staging directory until complete.
+	if _, err := os.Stat(filepath.Join(dir, "sub", "big.bin")); !os.IsNotExist(err) {
+		t.Error("file should not exist before upload completes")
+	}
+
+	if rec := tusPatch(handler, loc, "0", "again"); rec.Code != http.StatusConflict {
+		t.Errorf("stale offset: expected 409, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodHead, loc, "", nil))
+	if got := rec.Header().Get("Upload-Offset"); got != "5" {
+		t.Fatalf("resume HEAD: expected offset 5, got %q", got)
+	}
+
+	rec = tusPatch(handler, loc, "5", " world")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("final PATCH: got %d offset=%q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "sub", "big.bin"))
+	if err != nil {
+		t.Fatalf("completed upload not found: %v", err)
+	}
+	if string(content) != "hello world" {
+		t.Errorf("content mismatch: %q", content)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, tusStagingDir))
+	if len(entries) != 0 {
+		t.Errorf("staging directory should be empty, has %d entries", len(entries))
+	}
+}
+
+func TestTusErrors(t *testing.T) {
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 10})
+
+	t.Run("missing Tus-Resumable", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/__tus/", nil))
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412, got %d", rec.Code)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+			"Upload-Length":   "11",
+			"Upload-Metadata": tusMeta("filename", "a.txt"),
+		}))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", rec.Code)
+		}
+	})
+
+	t.Run("missing filename", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{"Upload-Length": "5"}))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", rec.Code)
+		}
+	})
+
+	t.Run("unknown upload", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodHead, "/__tus/"+strings.Repeat("a", 32), "", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rec.Code)
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodHead, "/__tus/..%2f..%2fetc", "", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rec.Code)
+		}
+	})
+
+	t.Run("wrong content type", func(t *testing.T) {
+		loc := tusCreate(t, handler, "5", tusMeta("filename", "a.txt"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodPatch, loc, "hello", map[string]string{"Upload-Offset": "0"}))
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected 415, got %d", rec.Code)
+		}
+	})
+
+	t.Run("more data than Upload-Length", func(t *testing.T) {
+		loc := tusCreate(t, handler, "3", tusMeta("filename", "b.txt"))
+		if rec := tusPatch(handler, loc, "0", "toolong"); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413, got %d", rec.Code)
+		}
+	})
+}
+
+func TestTusTermination(t *testing.T) {
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024})
+	loc := tusCreate(t, handler, "5", tusMeta("filename", "a.txt"))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodDelete, loc, "", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodHead, loc, "", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after termination, got %d", rec.Code)
+	}
+}
+
+func TestTusOwner(t *testing.T) {
+	creds = &AuthCreds{Username: "user", Password: "pass"}
+	defer func() { creds = nil }()
+
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024})
+
+	rec := httptest.NewRecorder()
+	req := tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMeta("filename", "a.txt"),
+	})
+	req.SetBasicAuth("user", "pass")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", rec.Code)
+	}
+	loc := rec.Header().Get("Location")
+
+	// Anyone other than the creator sees no such upload.
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(method, loc, "hello", map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "0",
+		}))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s by another client: expected 404, got %d", method, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	req = tusRequest(http.MethodHead, loc, "", nil)
+	req.SetBasicAuth("user", "pass")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("HEAD by the creator: got %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	dir := t.TempDir()
+	store := newTusStore(&UploadConfig{Dir: dir, MaxBytes: 1024})
+	store.expiry = -time.Minute // already expired on creation
+	handler := http.StripPrefix("/__tus", store)
+
+	loc := tusCreate(t, handler, "5", tusMeta("filename", "a.txt"))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodHead, loc, "", nil))
+	if rec.Code != http.StatusGone {
+		t.Errorf("expected 410 for expired upload, got %d", rec.Code)
+	}
+
+	// Abandoned uploads are swept when new ones are created.
+	stale := tusCreate(t, handler, "5", tusMeta("filename", "b.txt"))
+	store.cleaned = time.Time{}
+	store.cleanup(time.Now())
+	id := strings.TrimPrefix(stale, "/__tus/")
+	if _, err := os.Stat(store.dataPath(id)); !os.IsNotExist(err) {
+		t.Error("expired upload should have been removed by cleanup")
+	}
+}
+
+func TestTusZeroLength(t *testing.T) {
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024})
+	tusCreate(t, handler, "0", tusMeta("filename", "empty.txt"))
+
+	if fi, err := os.Stat(filepath.Join(dir, "empty.txt")); err != nil || fi.Size() != 0 {
+		t.Errorf("expected empty file to be created immediately: %v", err)
+	}
+}
+
+func TestTusConflict(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "report.txt"), []byte("old"), 0644)
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024, Conflict: conflictReject})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+		"Upload-Length":   "3",
+		"Upload-Metadata": tusMeta("filename", "report.txt"),
+	}))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reject: expected 409 at creation, got %d", rec.Code)
+	}
+
+	loc := tusCreate(t, handler, "3", tusMeta("filename", "folder/report.txt", "conflict", conflictOverwrite))
+	if rec := tusPatch(handler, loc, "0", "new"); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch: expected 204, got %d", rec.Code)
+	}
+	loc = tusCreate(t, handler, "3", tusMeta("filename", "report.txt", "conflict", conflictOverwrite))
+	if rec := tusPatch(handler, loc, "0", "new"); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch: expected 204, got %d", rec.Code)
+	}
+	for _, name := range []string{"report.txt", "folder/report.txt"} {
+		if content, _ := os.ReadFile(filepath.Join(dir, name)); string(content) != "new" {
+			t.Errorf("%s: expected overwritten content, got %q", name, content)
+		}
+	}
+}
+
+func TestTusGuardrails(t *testing.T) {
+	dir := t.TempDir()
+	handler := tusHandler(&UploadConfig{Dir: dir, MaxBytes: 1024, DenyExt: []string{".exe"}, DenyMIME: []string{"text/html"}, TotalQuota: 100,
+		Hide: newVisibility(false, []string{"*.key"})})
+
+	create := func(length, meta string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+			"Upload-Length":   length,
+			"Upload-Metadata": meta,
+		}))
+		return rec.Code
+	}
+	if code := create("3", tusMeta("filename", "run.exe")); code != http.StatusUnsupportedMediaType {
+		t.Errorf("denied extension: expected 415, got %d", code)
+	}
+	if code := create("3", tusMeta("filename", "server.key", "path", "certs")); code != http.StatusForbidden {
+		t.Errorf("hidden target: expected 403, got %d", code)
+	}
+	if code := create("500", tusMeta("filename", "big.bin")); code != http.StatusInsufficientStorage {
+		t.Errorf("over quota: expected 507, got %d", code)
+	}
+
+	// hello's SHA-256 does not match, so the upload is dropped.
+	loc := tusCreate(t, handler, "5", tusMeta("filename", "a.txt", "sha256", strings.Repeat("0", 64)))
+	if rec := tusPatch(handler, loc, "0", "hello"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("checksum mismatch: expected 422, got %d", rec.Code)
+	}
+	loc = tusCreate(t, handler, "6", tusMeta("filename", "page.txt"))
+	if rec := tusPatch(handler, loc, "0", "<html>"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("denied content type: expected 415, got %d", rec.Code)
+	}
+	for _, name := range []string{"a.txt", "page.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s should not have been saved", name)
+		}
+	}
+}
+
+func TestTusQuotaReservation(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &UploadConfig{Dir: dir, MaxBytes: 1024, TotalQuota: 100}
+	handler := tusHandler(cfg)
+
+	// The first upload holds 60 bytes before any data arrives, so a second
+	// one that would fit on its own is refused.
+	first := tusCreate(t, handler, "60", tusMeta("filename", "a.bin"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodPost, "/__tus/", "", map[string]string{
+		"Upload-Length":   "60",
+		"Upload-Metadata": tusMeta("filename", "b.bin"),
+	}))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 while the first upload is reserved, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, tusRequest(http.MethodDelete, first, "", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", rec.Code)
+	}
+	second := tusCreate(t, handler, "60", tusMeta("filename", "b.bin"))
+	if rec := tusPatch(handler, second, "0", strings.Repeat("b", 60)); rec.Code != http.StatusNoContent {
+		t.Fatalf("patch: expected 204, got %d", rec.Code)
+	}
+	if got := usageFor(dir).stored(time.Now()); got != 60 {
+		t.Errorf("expected 60 bytes stored and nothing reserved, got %d", got)
+	}
+}
+
+func TestTusMetadata(t *testing.T) {
+	meta, err := parseTusMetadata(tusMeta("filename", "Résumé.pdf", "path", "docs") + ",flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["filename"] != "Résumé.pdf" || meta["path"] != "docs" {
+		t.Errorf("unexpected metadata %v", meta)
+	}
+	if _, ok := meta["flag"]; !ok {
+		t.Error("keys without values should be kept")
+	}
+
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Error("expected error for invalid base64")
+	}
+
+	roundTrip, _ := parseTusMetadata(encodeTusMetadata(meta))
+	if roundTrip["filename"] != "Résumé.pdf" {
+		t.Errorf("round trip failed: %v", roundTrip)
+	}
+}
@@ -21,7 +21,15 @@ type fileInfo struct {
 	IsDir    bool      `json:"isDir"`
 }
 
-func uiHandler(rootDir string, uploadEnabled, zipEnabled, showDotfiles bool) http.Handler {
+// uiOptions says which optional features the browser UI should offer.
+type uiOptions struct {
+	Upload bool
+	Zip    bool
+	Manage bool
+	Hide   *visibility
+}
+
+func uiHandler(rootDir string, opts uiOptions) http.Handler {
 	fileServer := http.FileServer(http.Dir(rootDir))
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +43,7 @@ func uiHandler(rootDir string, uploadEnabled, zipEnabled, showDotfiles bool) htt
 		fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
 
 		info, err := os.Stat(fullPath)
-		if err != nil {
+		if err != nil || opts.Hide.hidden(relPath, info.IsDir()) {
 			http.NotFound(w, r)
 			return
 		}
@@ -56,10 +64,9 @@ func uiHandler(rootDir string, uploadEnabled, zipEnabled, showDotfiles bool) htt
 			return
 		}
 
-		isRoot := relPath == "" || relPath == "."
 		var files []fileInfo
 		for _, e := range entries {
-			if !showDotfiles && isRoot && strings.HasPrefix(e.Name(), ".") {
+			if opts.Hide.hiddenEntry(path.Join(relPath, e.Name()), e.IsDir()) {
 				continue
 			}
 			fi, err := e.Info()
@@ -92,8 +99,9 @@ func uiHandler(rootDir string, uploadEnabled, zipEnabled, showDotfiles bool) htt
 		pathJSON, _ := json.Marshal(displayPath)
 		dataScript := `<script>window.DSERVE={files:` + string(filesJSON) +
 			`,path:` + string(pathJSON) +
-			`,uploadEnabled:` + boolStr(uploadEnabled) +
-			`,zipEnabled:` + boolStr(zipEnabled) + `};</script>`
+			`,uploadEnabled:` + boolStr(opts.Upload) +
+			`,zipEnabled:` + boolStr(opts.Zip) +
+			`,manageEnabled:` + boolStr(opts.Manage) + `};</script>`
 
 		html := strings.Replace(uiHTML, "<!-- DSERVE_DATA_PLACEHOLDER -->", dataScript, 1)
 
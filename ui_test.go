@@ -18,7 +18,7 @@ func TestUIHandler(t *testing.T) {
 	_ = os.Mkdir(filepath.Join(dir, "subdir"), 0755)
 	_ = os.WriteFile(filepath.Join(dir, "subdir", "nested.txt"), []byte("nested"), 0644)
 
-	handler := uiHandler(dir, false, false, false)
+	handler := uiHandler(dir, uiOptions{})
 
 	t.Run("serves HTML for directory", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/", nil)
@@ -137,7 +137,7 @@ func TestUIHandlerWithFeatures(t *testing.T) {
 	_ = os.WriteFile(filepath.Join(dir, "test.txt"), []byte("test"), 0644)
 
 	t.Run("includes upload flag in data", func(t *testing.T) {
-		handler := uiHandler(dir, true, false, false)
+		handler := uiHandler(dir, uiOptions{Upload: true})
 		req := httptest.NewRequest("GET", "/", nil)
 		rec := httptest.NewRecorder()
 
@@ -153,7 +153,7 @@ func TestUIHandlerWithFeatures(t *testing.T) {
 	})
 
 	t.Run("includes zip flag in data", func(t *testing.T) {
-		handler := uiHandler(dir, false, true, false)
+		handler := uiHandler(dir, uiOptions{Zip: true})
 		req := httptest.NewRequest("GET", "/", nil)
 		rec := httptest.NewRecorder()
 
@@ -167,6 +167,18 @@ func TestUIHandlerWithFeatures(t *testing.T) {
 			t.Error("response should contain zipEnabled:true")
 		}
 	})
+
+	t.Run("includes manage flag in data", func(t *testing.T) {
+		handler := uiHandler(dir, uiOptions{Manage: true})
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if !strings.Contains(rec.Body.String(), "manageEnabled:true") {
+			t.Error("response should contain manageEnabled:true")
+		}
+	})
 }
 
 func TestUIHandlerHidesDotfiles(t *testing.T) {
@@ -174,7 +186,7 @@ func TestUIHandlerHidesDotfiles(t *testing.T) {
 	_ = os.WriteFile(filepath.Join(dir, ".hidden"), []byte("secret"), 0644)
 	_ = os.WriteFile(filepath.Join(dir, "visible.txt"), []byte("public"), 0644)
 
-	handler := uiHandler(dir, false, false, false)
+	handler := uiHandler(dir, uiOptions{})
 
 	req := httptest.NewRequest("GET", "/", nil)
 	req.Header.Set("Accept", "application/json")
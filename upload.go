@@ -1,120 +1,446 @@
 package main
 
 import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 type uploadResponse struct {
-	Success  bool   `json:"success"`
-	Filename string `json:"filename,omitempty"`
-	Size     int64  `json:"size,omitempty"`
+	Success  bool           `json:"success"`
+	Filename string         `json:"filename,omitempty"`
+	Size     int64          `json:"size,omitempty"`
+	SHA256   string         `json:"sha256,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Files    []uploadResult `json:"files,omitempty"`
+}
+
+// uploadResult reports the outcome for one file of a multi-file upload.
+type uploadResult struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path,omitempty"` // relative to the upload root
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"` // an existing file was kept
 	Error    string `json:"error,omitempty"`
 }
 
-func uploadHandler(destDir string, maxSize int64) http.Handler {
+// maxFieldBytes caps non-file form fields such as "path".
+const maxFieldBytes = 4096
+
+func uploadHandler(cfg *UploadConfig) http.Handler {
+	destDir := cfg.Dir
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "method not allowed"})
+			writeUploadError(w, &uploadError{http.StatusMethodNotAllowed, "method not allowed"})
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes)
 
-		if err := r.ParseMultipartForm(maxSize); err != nil {
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "file too large"})
+		// Parts are streamed one at a time, so memory use does not grow
+		// with the file size.
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeUploadError(w, &uploadError{http.StatusBadRequest, "expected a multipart/form-data body"})
 			return
 		}
 
-		file, header, err := r.FormFile("file")
+		// With ?path= the destination is known up front and files stream
+		// straight into it. A "path" form field can arrive after the files,
+		// so staged files are only renamed into place once the body is read.
+		subdir := r.URL.Query().Get("path")
+		conflict := r.URL.Query().Get("conflict")
+		user := requestIdentity(r)
+		if hiddenUpload(cfg, safeRelPath(subdir), true) {
+			writeUploadError(w, errHiddenTarget)
+			return
+		}
+		stageDir, err := uploadSubdir(destDir, subdir)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "no file provided"})
+			writeUploadError(w, &uploadError{http.StatusInternalServerError, "failed to create directory"})
 			return
 		}
-		defer file.Close()
 
-		filename := safeFilename(header.Filename)
-		if filename == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "invalid filename"})
-			return
+		// The nth "sha256" field is the checksum of the nth file.
+		var sums []string
+		if sum := r.URL.Query().Get("sha256"); sum != "" {
+			sums = append(sums, sum)
 		}
 
-		subdir := safeFilename(r.FormValue("path"))
-		targetDir := destDir
-		if subdir != "" {
-			targetDir = filepath.Join(destDir, subdir)
-			if err := os.MkdirAll(targetDir, 0755); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_ = json.NewEncoder(w).Encode(uploadResponse{Error: "failed to create directory"})
+		var files []*stagedFile
+		var pending int64
+		defer func() {
+			for _, f := range files {
+				if f.tmp != "" {
+					os.Remove(f.tmp)
+				}
+			}
+		}()
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				writeUploadError(w, bodyError(err))
 				return
 			}
-		}
 
-		destPath := uniqueFilename(targetDir, filename)
+			name := partFilename(part)
+			switch {
+			case name == "":
+				field := part.FormName()
+				if field != "path" && field != "conflict" && field != "sha256" {
+					break
+				}
+				value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes))
+				if err != nil {
+					writeUploadError(w, bodyError(err))
+					return
+				}
+				switch field {
+				case "path":
+					subdir = string(value)
+				case "conflict":
+					conflict = string(value)
+				case "sha256":
+					sums = append(sums, strings.TrimSpace(string(value)))
+				}
+			default:
+				f, fatal := receiveFile(cfg, stageDir, name, user, pending, part)
+				if fatal != nil {
+					writeUploadError(w, fatal)
+					return
+				}
+				if f.err == nil {
+					pending += f.size
+				}
+				files = append(files, f)
+			}
+			part.Close()
+		}
 
-		dst, err := os.Create(destPath)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "failed to create file"})
+		if len(files) == 0 {
+			writeUploadError(w, &uploadError{http.StatusBadRequest, "no file provided"})
 			return
 		}
-		defer dst.Close()
 
-		size, err := io.Copy(dst, file)
-		if err != nil {
-			os.Remove(destPath)
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "failed to save file"})
+		policy, uerr := conflictPolicy(conflict, cfg.Conflict)
+		if uerr != nil {
+			writeUploadError(w, uerr)
 			return
 		}
 
-		_ = json.NewEncoder(w).Encode(uploadResponse{
-			Success:  true,
-			Filename: filepath.Base(destPath),
-			Size:     size,
-		})
+		resp := uploadResponse{Files: make([]uploadResult, len(files))}
+		var firstErr *uploadError
+		for i, f := range files {
+			if f.err == nil && i < len(sums) {
+				f.err = verifyChecksum(sums[i], f.sha256)
+			}
+			if f.err == nil {
+				f.err = f.commit(cfg, subdir, policy)
+			}
+			if f.err == nil && !f.skipped && countsUsage(cfg) {
+				usageFor(cfg.Dir).add(user, f.size)
+			}
+			resp.Files[i] = f.result(destDir)
+			if f.err != nil && firstErr == nil {
+				firstErr = f.err
+			}
+			if f.err == nil && !f.skipped {
+				fireUploadHooks(cfg, newUploadEvent(resp.Files[i], user))
+			}
+		}
+
+		failed := 0
+		for _, res := range resp.Files {
+			if res.Error != "" {
+				failed++
+			}
+		}
+		switch {
+		case failed == 0:
+			resp.Success = true
+			if len(files) == 1 {
+				resp.Filename, resp.Size, resp.SHA256 = resp.Files[0].Filename, resp.Files[0].Size, resp.Files[0].SHA256
+			}
+		case failed == len(files):
+			resp.Error = firstErr.msg
+			w.WriteHeader(firstErr.status)
+		default:
+			resp.Error = fmt.Sprintf("%d of %d files failed", failed, len(files))
+			w.WriteHeader(http.StatusMultiStatus)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
 	})
 }
 
-var safeFilenameRe = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+// receiveFile stages one file part after the type and space checks. A
+// failure that only concerns this file is reported in the returned
+// stagedFile; a broken request body is returned as fatal.
+func receiveFile(cfg *UploadConfig, stageDir, name, user string, pending int64, src io.Reader) (f *stagedFile, fatal *uploadError) {
+	relPath := safeRelPath(name)
+	if relPath == "" {
+		return &stagedFile{filename: name, err: &uploadError{http.StatusBadRequest, "invalid filename"}}, nil
+	}
+	if err := checkExtension(cfg, relPath); err != nil {
+		return &stagedFile{filename: relPath, err: err}, nil
+	}
+
+	br := bufio.NewReaderSize(src, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, bodyError(err)
+	}
+	if err := checkContentType(cfg, head); err != nil {
+		return &stagedFile{filename: relPath, err: err}, nil
+	}
+	limited, uerr := limitUpload(cfg, user, pending, br)
+	if uerr != nil {
+		return &stagedFile{filename: relPath, err: uerr}, nil
+	}
+
+	f, uerr = stageUpload(stageDir, relPath, limited)
+	if uerr != nil {
+		if uerr.fromBody() {
+			return nil, uerr
+		}
+		return &stagedFile{filename: relPath, err: uerr}, nil
+	}
+	return f, nil
+}
+
+// partFilename returns the filename exactly as the client sent it.
+// Part.FileName strips directories, which folder uploads need.
+func partFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// uploadError is an upload failure with the status and message reported to
+// the client.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string { return e.msg }
+
+// Errors reading the request body end the whole request.
+var (
+	errBodyTooLarge   = &uploadError{http.StatusRequestEntityTooLarge, "file too large"}
+	errBodyIncomplete = &uploadError{http.StatusBadRequest, "upload incomplete"}
+	errBodyMalformed  = &uploadError{http.StatusBadRequest, "malformed multipart body"}
+)
+
+// bodyError classifies a failure reading the request body.
+func bodyError(err error) *uploadError {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		return errBodyTooLarge
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errBodyIncomplete
+	default:
+		return errBodyMalformed
+	}
+}
+
+func (e *uploadError) fromBody() bool {
+	return e == errBodyTooLarge || e == errBodyIncomplete || e == errBodyMalformed
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	ue, ok := err.(*uploadError)
+	if !ok {
+		ue = &uploadError{http.StatusInternalServerError, err.Error()}
+	}
+	w.WriteHeader(ue.status)
+	_ = json.NewEncoder(w).Encode(uploadResponse{Error: ue.msg})
+}
 
-func safeFilename(name string) string {
-	name = filepath.Base(name)
-	name = safeFilenameRe.ReplaceAllString(name, "_")
-	name = strings.TrimLeft(name, ".")
-	return name
+// stagedFile is an upload written to a temp file, waiting to be renamed
+// into place.
+type stagedFile struct {
+	tmp      string
+	filename string // sanitized path relative to the upload subdirectory
+	dest     string
+	size     int64
+	sha256   string
+	md5      string // for Content-MD5 and Digest checks on PUT
+	skipped  bool
+	err      *uploadError
 }
 
-func uniqueFilename(dir, name string) string {
-	path := filepath.Join(dir, name)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return path
+// commit moves the staged file to its final location, resolving name
+// conflicts with policy.
+func (f *stagedFile) commit(cfg *UploadConfig, subdir, policy string) *uploadError {
+	dest, uerr := uploadTarget(cfg, subdir, f.filename)
+	if uerr != nil {
+		return uerr
+	}
+	final, skipped, uerr := placeUpload(f.tmp, dest, policy, cfg.Backup)
+	if uerr != nil {
+		return uerr
 	}
+	if !skipped {
+		f.tmp = ""
+	}
+	f.dest, f.skipped = final, skipped
+	return nil
+}
 
-	ext := filepath.Ext(name)
-	base := strings.TrimSuffix(name, ext)
+func (f *stagedFile) result(destDir string) uploadResult {
+	if f.err != nil {
+		return uploadResult{Filename: path.Base(f.filename), Error: f.err.msg}
+	}
+	rel, _ := filepath.Rel(destDir, f.dest)
+	return uploadResult{Filename: filepath.Base(f.dest), Path: filepath.ToSlash(rel), Size: f.size, SHA256: f.sha256, Skipped: f.skipped}
+}
+
+// stageUpload streams src into a hidden temp file in dir. The temp file is
+// removed if anything goes wrong.
+func stageUpload(dir, filename string, src io.Reader) (*stagedFile, *uploadError) {
+	tmp, err := os.CreateTemp(dir, ".dserve-upload-*")
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, "failed to create file"}
+	}
 
-	for i := 1; i < 1000; i++ {
-		newName := fmt.Sprintf("%s_%d%s", base, i, ext)
-		path = filepath.Join(dir, newName)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			return path
+	h, m := sha256.New(), md5.New()
+	dst := &trackingWriter{w: io.MultiWriter(tmp, h, m)}
+	size, err := io.Copy(dst, src)
+	closeErr := tmp.Close()
+	if err == nil && closeErr != nil {
+		dst.err, err = closeErr, closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		if dst.err != nil {
+			return nil, &uploadError{http.StatusInternalServerError, "failed to save file"}
+		}
+		// Checks wrapped around src report their own errors.
+		var ue *uploadError
+		if errors.As(err, &ue) {
+			return nil, ue
 		}
+		return nil, bodyError(err)
 	}
-	return path
+	return &stagedFile{
+		tmp:      tmp.Name(),
+		filename: filename,
+		size:     size,
+		sha256:   hex.EncodeToString(h.Sum(nil)),
+		md5:      hex.EncodeToString(m.Sum(nil)),
+	}, nil
+}
+
+// trackingWriter remembers write errors so a failed copy can be blamed on
+// the disk rather than the client.
+type trackingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// uploadPermission restricts uploads to the given identities (basic auth
+// users or client certificate CNs). An empty list allows everyone.
+func uploadPermission(next http.Handler, users []string) http.Handler {
+	if len(users) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := requestIdentity(r)
+		if user == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Basic realm="dserve Basic Authentication"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "authentication required"})
+			return
+		}
+		if !slices.Contains(users, user) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(uploadResponse{Error: "upload not permitted for " + user})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadSubdir returns the directory for uploads to subdir, creating it if
+// needed.
+func uploadSubdir(destDir, subdir string) (string, error) {
+	subdir = safeRelPath(subdir)
+	if subdir == "" {
+		return destDir, nil
+	}
+	targetDir := filepath.Join(destDir, filepath.FromSlash(subdir))
+	return targetDir, os.MkdirAll(targetDir, 0755)
+}
+
+// errHiddenTarget refuses uploads to paths the visibility policy hides.
+var errHiddenTarget = &uploadError{http.StatusForbidden, "hidden path not allowed"}
+
+// uploadPath returns where name, a relative path inside subdir, is saved,
+// without creating anything. Hidden paths are refused, so an upload
+// cannot plant a server.key or write into a denied node_modules/.
+func uploadPath(cfg *UploadConfig, subdir, name string) (string, *uploadError) {
+	name = safeRelPath(name)
+	if name == "" {
+		return "", &uploadError{http.StatusBadRequest, "invalid filename"}
+	}
+	rel := path.Join(safeRelPath(subdir), name)
+	if hiddenUpload(cfg, rel, false) {
+		return "", errHiddenTarget
+	}
+	return filepath.Join(cfg.Dir, filepath.FromSlash(rel)), nil
+}
+
+// uploadTarget creates the directories for name, a relative path inside
+// subdir, and returns the path the file should be saved at.
+func uploadTarget(cfg *UploadConfig, subdir, name string) (string, *uploadError) {
+	dest, uerr := uploadPath(cfg, subdir, name)
+	if uerr != nil {
+		return "", uerr
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", &uploadError{http.StatusInternalServerError, "failed to create directory"}
+	}
+	return dest, nil
+}
+
+// hiddenUpload reports whether rel, relative to the upload directory, is
+// hidden in the served tree.
+func hiddenUpload(cfg *UploadConfig, rel string, isDir bool) bool {
+	return cfg.Hide.hidden(path.Join(policyPrefix(".", cfg.Dir), rel), isDir)
 }
 
 func parseSize(s string) (int64, error) {
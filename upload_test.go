@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -47,53 +49,9 @@ func TestParseSize(t *testing.T) {
 	}
 }
 
-func TestSafeFilename(t *testing.T) {
-	tests := []struct {
-		input    string
-		expected string
-	}{
-		{"file.txt", "file.txt"},
-		{"my file.txt", "my_file.txt"},
-		{"../../../etc/passwd", "passwd"},
-		{"/absolute/path/file.txt", "file.txt"},
-		{".hidden", "hidden"},
-		{"...dots", "dots"},
-		{"file<>|:*.txt", "file_____.txt"},
-		{"normal-file_123.txt", "normal-file_123.txt"},
-	}
-
-	for _, tt := range tests {
-		result := safeFilename(tt.input)
-		if result != tt.expected {
-			t.Errorf("safeFilename(%q) = %q, want %q", tt.input, result, tt.expected)
-		}
-	}
-}
-
-func TestUniqueFilename(t *testing.T) {
-	dir := t.TempDir()
-
-	path := uniqueFilename(dir, "test.txt")
-	if filepath.Base(path) != "test.txt" {
-		t.Errorf("uniqueFilename should return test.txt when file doesn't exist, got %s", filepath.Base(path))
-	}
-
-	_ = os.WriteFile(filepath.Join(dir, "test.txt"), []byte("content"), 0644)
-	path = uniqueFilename(dir, "test.txt")
-	if filepath.Base(path) != "test_1.txt" {
-		t.Errorf("uniqueFilename should return test_1.txt when test.txt exists, got %s", filepath.Base(path))
-	}
-
-	_ = os.WriteFile(filepath.Join(dir, "test_1.txt"), []byte("content"), 0644)
-	path = uniqueFilename(dir, "test.txt")
-	if filepath.Base(path) != "test_2.txt" {
-		t.Errorf("uniqueFilename should return test_2.txt when test.txt and test_1.txt exist, got %s", filepath.Base(path))
-	}
-}
-
 func TestUploadHandler(t *testing.T) {
 	dir := t.TempDir()
-	handler := uploadHandler(dir, 1024*1024)
+	handler := uploadHandler(&UploadConfig{Dir: dir, MaxBytes: 1024 * 1024})
 
 	t.Run("successful upload", func(t *testing.T) {
 		body := &bytes.Buffer{}
@@ -164,7 +122,7 @@ func TestUploadHandler(t *testing.T) {
 	})
 
 	t.Run("file too large", func(t *testing.T) {
-		smallHandler := uploadHandler(dir, 10)
+		smallHandler := uploadHandler(&UploadConfig{Dir: dir, MaxBytes: 10})
 
 		body := &bytes.Buffer{}
 		writer := multipart.NewWriter(body)
@@ -249,3 +207,284 @@ func TestUploadHandler(t *testing.T) {
 	})
 }
 
+func TestUploadHandlerHidden(t *testing.T) {
+	dir := t.TempDir()
+	handler := uploadHandler(&UploadConfig{Dir: dir, MaxBytes: 1024, Hide: newVisibility(false, []string{"*.key", "node_modules/"})})
+
+	upload := func(query, name string) (int, uploadResponse) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", name)
+		_, _ = part.Write([]byte("x"))
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/__upload"+query, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var resp uploadResponse
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	if code, resp := upload("", "certs/server.key"); code != http.StatusForbidden || resp.Error != "hidden path not allowed" {
+		t.Errorf("hidden file: got %d %q, want 403", code, resp.Error)
+	}
+	if code, _ := upload("?path=web/node_modules", "index.js"); code != http.StatusForbidden {
+		t.Errorf("hidden directory: got %d, want 403", code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("refused uploads left %v behind", entries)
+	}
+}
+
+func TestUploadPermission(t *testing.T) {
+	creds = &AuthCreds{Username: "alice", Password: "secret"}
+	defer func() { creds = nil }()
+
+	handler := uploadPermission(fakeFSHandler, []string{"alice", "ci-runner"})
+
+	tests := []struct {
+		name       string
+		setup      func(r *http.Request)
+		wantStatus int
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"allowed basic auth user", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"allowed client cert", func(r *http.Request) { r.TLS = withClientCert("ci-runner") }, http.StatusOK},
+		{"other client cert", func(r *http.Request) { r.TLS = withClientCert("intruder") }, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/__upload", nil)
+			tt.setup(req)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+
+	if h := uploadPermission(fakeFSHandler, nil); h == nil {
+		t.Error("expected handler for empty user list")
+	}
+}
+
+func TestUploadHandlerErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name        string
+		maxSize     int64
+		contentType string
+		body        func(boundary string) string
+		wantStatus  int
+		wantError   string
+	}{
+		{
+			name:        "not multipart",
+			maxSize:     1024,
+			contentType: "application/json",
+			body:        func(string) string { return `{"file":"x"}` },
+			wantStatus:  http.StatusBadRequest,
+			wantError:   "expected a multipart/form-data body",
+		},
+		{
+			name:        "truncated body",
+			maxSize:     1024,
+			contentType: "multipart/form-data; boundary=XYZ",
+			body: func(string) string {
+				return "--XYZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\nhalf a fi"
+			},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "upload incomplete",
+		},
+		{
+			name:        "garbage body",
+			maxSize:     1024,
+			contentType: "multipart/form-data; boundary=XYZ",
+			body:        func(string) string { return "this is not multipart at all" },
+			wantStatus:  http.StatusBadRequest,
+			wantError:   "malformed multipart body",
+		},
+		{
+			name:        "too large",
+			maxSize:     100,
+			contentType: "multipart/form-data; boundary=XYZ",
+			body: func(string) string {
+				return "--XYZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\n" +
+					strings.Repeat("x", 500) + "\r\n--XYZ--\r\n"
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantError:  "file too large",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/__upload", strings.NewReader(tt.body("")))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			uploadHandler(&UploadConfig{Dir: dir, MaxBytes: tt.maxSize}).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			var resp uploadResponse
+			_ = json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Error != tt.wantError {
+				t.Errorf("expected error %q, got %q", tt.wantError, resp.Error)
+			}
+		})
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("failed uploads should leave no files behind, found %d", len(entries))
+	}
+}
+
+func TestUploadHandlerNoTempFilesLeft(t *testing.T) {
+	dir := t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "a.txt")
+	_, _ = part.Write([]byte("content"))
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/__upload?path=sub", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadHandler(&UploadConfig{Dir: dir, MaxBytes: 1024}).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "sub"))
+	if len(entries) != 1 || entries[0].Name() != "a.txt" {
+		t.Errorf("expected only a.txt in sub, got %v", entries)
+	}
+}
+
+func TestUploadHandlerStreams(t *testing.T) {
+	const size = 64 << 20
+	dir := t.TempDir()
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, _ := writer.CreateFormFile("file", "big.bin")
+		chunk := bytes.Repeat([]byte("x"), 32<<10)
+		for written := 0; written < size; written += len(chunk) {
+			if _, err := part.Write(chunk); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		writer.Close()
+		pw.Close()
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/__upload", pr)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	uploadHandler(&UploadConfig{Dir: dir, MaxBytes: size * 2}).ServeHTTP(rec, req)
+	runtime.ReadMemStats(&after)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "big.bin")); err != nil || fi.Size() != size {
+		t.Fatalf("expected %d byte file: %v", size, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("upload of %d bytes allocated %d bytes; expected streaming", size, allocated)
+	}
+}
+
+func TestUploadHandlerMultipleFiles(t *testing.T) {
+	upload := func(t *testing.T, dir, query string, files map[string]string, order []string) (*httptest.ResponseRecorder, uploadResponse) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, name := range order {
+			part, _ := writer.CreateFormFile("file", name)
+			_, _ = part.Write([]byte(files[name]))
+		}
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/__upload"+query, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandler(&UploadConfig{Dir: dir, MaxBytes: 1 << 20}).ServeHTTP(rec, req)
+
+		var resp uploadResponse
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec, resp
+	}
+
+	t.Run("folder upload keeps structure", func(t *testing.T) {
+		dir := t.TempDir()
+		files := map[string]string{
+			"site/index.html":     "<html>",
+			"site/css/main.css":   "body{}",
+			"site/img/logo.svg":   "<svg>",
+			"site/img/../../x.js": "escape",
+		}
+		order := []string{"site/index.html", "site/css/main.css", "site/img/logo.svg", "site/img/../../x.js"}
+		rec, resp := upload(t, dir, "?path=/docs", files, order)
+
+		if rec.Code != http.StatusOK || !resp.Success {
+			t.Fatalf("expected 200 success, got %d: %+v", rec.Code, resp)
+		}
+		wantPaths := []string{"docs/site/index.html", "docs/site/css/main.css", "docs/site/img/logo.svg", "docs/x.js"}
+		if len(resp.Files) != len(wantPaths) {
+			t.Fatalf("expected %d results, got %d", len(wantPaths), len(resp.Files))
+		}
+		for i, want := range wantPaths {
+			if resp.Files[i].Path != want {
+				t.Errorf("result %d: expected path %q, got %q", i, want, resp.Files[i].Path)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(want)))
+			if err != nil || string(content) != files[order[i]] {
+				t.Errorf("%s: content %q, err %v", want, content, err)
+			}
+		}
+		if resp.Filename != "" {
+			t.Errorf("top-level filename should only be set for single uploads, got %q", resp.Filename)
+		}
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		dir := t.TempDir()
+		rec, resp := upload(t, dir, "", map[string]string{"ok.txt": "fine", "..": "bad"}, []string{"ok.txt", ".."})
+
+		if rec.Code != http.StatusMultiStatus {
+			t.Errorf("expected 207, got %d", rec.Code)
+		}
+		if resp.Success || resp.Error != "1 of 2 files failed" {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+		if len(resp.Files) != 2 || resp.Files[0].Error != "" || resp.Files[1].Error != "invalid filename" {
+			t.Errorf("unexpected per-file results: %+v", resp.Files)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "ok.txt")); err != nil {
+			t.Errorf("successful file should be kept: %v", err)
+		}
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		dir := t.TempDir()
+		rec, resp := upload(t, dir, "", map[string]string{"..": "bad"}, []string{".."})
+
+		if rec.Code != http.StatusBadRequest || resp.Error != "invalid filename" {
+			t.Errorf("expected 400 invalid filename, got %d %q", rec.Code, resp.Error)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Guardrails for uploads: allowed file types, quotas, free disk space and
+// checksums. Each check returns an *uploadError that fails only the file
+// concerned.
+
+const usageFile = ".dserve-usage.json"
+
+// parseExtList parses "pdf, .PNG" into [".pdf" ".png"].
+func parseExtList(s string) []string {
+	var exts []string
+	for _, ext := range parseList(s) {
+		exts = append(exts, "."+strings.TrimPrefix(strings.ToLower(ext), "."))
+	}
+	return exts
+}
+
+// checkExtension applies UploadConfig.AllowExt and DenyExt to name.
+func checkExtension(cfg *UploadConfig, name string) *uploadError {
+	ext := strings.ToLower(filepath.Ext(name))
+	if len(cfg.AllowExt) > 0 && !slices.Contains(cfg.AllowExt, ext) ||
+		slices.Contains(cfg.DenyExt, ext) {
+		if ext == "" {
+			return &uploadError{http.StatusUnsupportedMediaType, "files without an extension are not allowed"}
+		}
+		return &uploadError{http.StatusUnsupportedMediaType, "file type not allowed: " + ext}
+	}
+	return nil
+}
+
+// checkContentType sniffs head, the first bytes of a file, and applies
+// UploadConfig.AllowMIME and DenyMIME.
+func checkContentType(cfg *UploadConfig, head []byte) *uploadError {
+	if len(cfg.AllowMIME) == 0 && len(cfg.DenyMIME) == 0 {
+		return nil
+	}
+	typ, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if len(cfg.AllowMIME) > 0 && !matchMIME(cfg.AllowMIME, typ) || matchMIME(cfg.DenyMIME, typ) {
+		return &uploadError{http.StatusUnsupportedMediaType, "content type not allowed: " + typ}
+	}
+	return nil
+}
+
+// matchMIME reports whether typ matches one of patterns, which may end in
+// "/*" to match a whole family such as image/*.
+func matchMIME(patterns []string, typ string) bool {
+	for _, p := range patterns {
+		if p == typ || strings.HasSuffix(p, "/*") && strings.HasPrefix(typ, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffFile reads the first 512 bytes of a file for content type checks.
+func sniffFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// uploadAllowance returns how many more bytes user may write, or -1 for no
+// limit, along with the error to report when that is exceeded. pending
+// counts bytes this request has staged but not yet committed.
+func uploadAllowance(cfg *UploadConfig, user string, pending int64) (int64, *uploadError) {
+	allowance := int64(-1)
+	var reason *uploadError
+	limit := func(n int64, err *uploadError) {
+		if allowance < 0 || n < allowance {
+			allowance, reason = max(n, 0), err
+		}
+	}
+
+	if cfg.UserQuota > 0 {
+		limit(cfg.UserQuota-usageFor(cfg.Dir).used(user)-pending,
+			&uploadError{http.StatusInsufficientStorage, "upload quota exceeded"})
+	}
+	if cfg.TotalQuota > 0 {
+		limit(cfg.TotalQuota-usageFor(cfg.Dir).stored(time.Now())-pending,
+			&uploadError{http.StatusInsufficientStorage, "storage quota exceeded"})
+	}
+	if cfg.MinFreeBytes > 0 {
+		if free, err := diskFree(cfg.Dir); err == nil {
+			limit(int64(free)-cfg.MinFreeBytes,
+				&uploadError{http.StatusInsufficientStorage, "not enough free disk space"})
+		}
+	}
+	return allowance, reason
+}
+
+// limitUpload wraps r so reading fails once the user's allowance is used
+// up. It fails straight away if nothing is left.
+func limitUpload(cfg *UploadConfig, user string, pending int64, r io.Reader) (io.Reader, *uploadError) {
+	allowance, reason := uploadAllowance(cfg, user, pending)
+	switch {
+	case allowance < 0:
+		return r, nil
+	case allowance == 0:
+		return nil, reason
+	}
+	return &allowanceReader{r: r, n: allowance, err: reason}, nil
+}
+
+// allowanceReader fails with err once more than n bytes are read.
+type allowanceReader struct {
+	r   io.Reader
+	n   int64
+	err *uploadError
+}
+
+func (a *allowanceReader) Read(p []byte) (int, error) {
+	// Read one byte past the allowance so an exact fit still succeeds.
+	if int64(len(p)) > a.n+1 {
+		p = p[:a.n+1]
+	}
+	n, err := a.r.Read(p)
+	a.n -= int64(n)
+	if a.n < 0 {
+		return n, a.err
+	}
+	return n, err
+}
+
+// verifyChecksum compares a client-supplied SHA-256 with the computed one.
+func verifyChecksum(want, got string) *uploadError {
+	if want == "" || strings.EqualFold(want, got) {
+		return nil
+	}
+	return &uploadError{http.StatusUnprocessableEntity, "checksum mismatch"}
+}
+
+// fileSHA256 hashes a file already on disk.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirSize totals the sizes of regular files under dir, leaving out
+// dserve's own files: the usage ledger and staged uploads.
+func dirSize(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), internalPrefix) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// usageRescan is how often the ledger re-measures the upload directory,
+// picking up files deleted or added outside of uploads.
+const usageRescan = time.Minute
+
+// countsUsage reports whether uploads must be recorded in the ledger.
+func countsUsage(cfg *UploadConfig) bool {
+	return cfg.UserQuota > 0 || cfg.TotalQuota > 0
+}
+
+// usageLedger records how many bytes each identity has uploaded. It is
+// stored as a dotfile in the upload directory so quotas survive restarts.
+// It also keeps a running total of the directory's size and the space
+// reserved by unfinished tus uploads, so checking a quota does not walk
+// the directory.
+type usageLedger struct {
+	path     string
+	dir      string
+	mu       sync.Mutex
+	users    map[string]int64
+	reserved map[string]int64 // by identity, for tus uploads in progress
+	size     int64            // bytes in dir at the last scan, plus uploads since
+	scanned  time.Time
+}
+
+var (
+	ledgersMu sync.Mutex
+	ledgers   = map[string]*usageLedger{}
+)
+
+// usageFor returns the shared ledger for an upload directory.
+func usageFor(dir string) *usageLedger {
+	ledgersMu.Lock()
+	defer ledgersMu.Unlock()
+	path := filepath.Join(dir, usageFile)
+	if l, ok := ledgers[path]; ok {
+		return l
+	}
+	l := &usageLedger{path: path, dir: dir, users: map[string]int64{}, reserved: map[string]int64{}}
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &l.users)
+	}
+	ledgers[path] = l
+	return l
+}
+
+// get returns the bytes user has uploaded.
+func (l *usageLedger) get(user string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.users[user]
+}
+
+// used returns the bytes user has uploaded or reserved.
+func (l *usageLedger) used(user string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.users[user] + l.reserved[user]
+}
+
+// stored returns the bytes the upload directory holds or has reserved,
+// measuring it again once usageRescan has passed.
+func (l *usageLedger) stored(now time.Time) int64 {
+	l.mu.Lock()
+	stale := now.Sub(l.scanned) >= usageRescan
+	l.mu.Unlock()
+	if stale {
+		size := dirSize(l.dir)
+		l.mu.Lock()
+		l.size, l.scanned = size, now
+		l.mu.Unlock()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := l.size
+	for _, n := range l.reserved {
+		total += n
+	}
+	return total
+}
+
+// add records n bytes saved by user.
+func (l *usageLedger) add(user string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users[user] += n
+	l.size += n
+	if b, err := json.Marshal(l.users); err == nil {
+		_ = os.WriteFile(l.path, b, 0644)
+	}
+}
+
+// reserve holds n bytes for an upload user has started; release gives
+// them back once it is saved or abandoned.
+func (l *usageLedger) reserve(user string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reserved[user] += n
+}
+
+func (l *usageLedger) release(user string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reserved[user] -= n; l.reserved[user] <= 0 {
+		delete(l.reserved, user)
+	}
+}
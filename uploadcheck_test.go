@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestParseExtList(t *testing.T) {
+	got := parseExtList("pdf, .PNG ,")
+	if strings.Join(got, " ") != ".pdf .png" {
+		t.Errorf("parseExtList = %v, want [.pdf .png]", got)
+	}
+}
+
+func TestCheckExtension(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   UploadConfig
+		file  string
+		allow bool
+	}{
+		{"no rules", UploadConfig{}, "run.exe", true},
+		{"allowed", UploadConfig{AllowExt: []string{".pdf"}}, "docs/Report.PDF", true},
+		{"not in allow list", UploadConfig{AllowExt: []string{".pdf"}}, "run.exe", false},
+		{"no extension with allow list", UploadConfig{AllowExt: []string{".pdf"}}, "Makefile", false},
+		{"denied", UploadConfig{DenyExt: []string{".exe"}}, "run.exe", false},
+		{"not denied", UploadConfig{DenyExt: []string{".exe"}}, "notes.txt", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExtension(&tt.cfg, tt.file)
+			if (err == nil) != tt.allow {
+				t.Errorf("checkExtension(%q) = %v, want allowed=%v", tt.file, err, tt.allow)
+			}
+			if err != nil && err.status != http.StatusUnsupportedMediaType {
+				t.Errorf("expected 415, got %d", err.status)
+			}
+		})
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   UploadConfig
+		head  []byte
+		allow bool
+	}{
+		{"no rules", UploadConfig{}, []byte("MZ\x90\x00"), true},
+		{"family allowed", UploadConfig{AllowMIME: []string{"image/*"}}, pngHeader, true},
+		{"exact allowed", UploadConfig{AllowMIME: []string{"text/plain"}}, []byte("hello"), true},
+		{"not allowed", UploadConfig{AllowMIME: []string{"image/*"}}, []byte("hello"), false},
+		{"renamed executable", UploadConfig{AllowMIME: []string{"image/*"}}, []byte("MZ\x90\x00\x03\x00\x00\x00"), false},
+		{"denied", UploadConfig{DenyMIME: []string{"text/html"}}, []byte("<!DOCTYPE html><html>"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkContentType(&tt.cfg, tt.head); (err == nil) != tt.allow {
+				t.Errorf("checkContentType = %v, want allowed=%v", err, tt.allow)
+			}
+		})
+	}
+}
+
+func TestUploadAllowance(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "existing.bin"), make([]byte, 600), 0644)
+	usageFor(dir).add("alice", 300)
+
+	tests := []struct {
+		name    string
+		cfg     UploadConfig
+		user    string
+		pending int64
+		want    int64
+		reason  string
+	}{
+		{"unlimited", UploadConfig{}, "alice", 0, -1, ""},
+		{"user quota", UploadConfig{UserQuota: 1000}, "alice", 0, 700, "upload quota exceeded"},
+		{"user quota with pending", UploadConfig{UserQuota: 1000}, "alice", 200, 500, "upload quota exceeded"},
+		{"other user", UploadConfig{UserQuota: 1000}, "bob", 0, 1000, "upload quota exceeded"},
+		{"total quota", UploadConfig{TotalQuota: 1000}, "alice", 0, 400, "storage quota exceeded"},
+		{"tightest wins", UploadConfig{UserQuota: 1000, TotalQuota: 1000}, "alice", 0, 400, "storage quota exceeded"},
+		{"exhausted", UploadConfig{TotalQuota: 500}, "alice", 0, 0, "storage quota exceeded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Dir = dir
+			got, reason := uploadAllowance(&tt.cfg, tt.user, tt.pending)
+			if got != tt.want {
+				t.Errorf("allowance = %d, want %d", got, tt.want)
+			}
+			if tt.reason != "" && (reason == nil || reason.msg != tt.reason) {
+				t.Errorf("reason = %v, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUsageLedgerRescan(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.bin"), make([]byte, 100), 0644)
+	_ = os.MkdirAll(filepath.Join(dir, tusStagingDir), 0755)
+	_ = os.WriteFile(filepath.Join(dir, tusStagingDir, "x.bin"), make([]byte, 500), 0644)
+
+	l := usageFor(dir)
+	now := time.Now()
+	if got := l.stored(now); got != 100 {
+		t.Fatalf("stored = %d, want 100 (staged files are not counted)", got)
+	}
+
+	l.add("alice", 50)
+	_ = os.WriteFile(filepath.Join(dir, "b.bin"), make([]byte, 200), 0644)
+	if got := l.stored(now.Add(time.Second)); got != 150 {
+		t.Errorf("stored = %d, want the running total 150 until the next scan", got)
+	}
+	if got := l.stored(now.Add(usageRescan)); got != 300 {
+		t.Errorf("stored = %d, want 300 after a rescan", got)
+	}
+
+	l.reserve("bob", 40)
+	if got, used := l.stored(now.Add(usageRescan)), l.used("bob"); got != 340 || used != 40 {
+		t.Errorf("with a reservation: stored = %d, used = %d, want 340 and 40", got, used)
+	}
+	l.release("bob", 40)
+	if got := l.used("bob"); got != 0 {
+		t.Errorf("used after release = %d, want 0", got)
+	}
+}
+
+func TestUploadAllowanceMinFree(t *testing.T) {
+	dir := t.TempDir()
+	free, err := diskFree(dir)
+	if err != nil {
+		t.Skipf("free space not available: %v", err)
+	}
+	cfg := &UploadConfig{Dir: dir, MinFreeBytes: int64(free) * 2}
+	if _, err := limitUpload(cfg, "", 0, strings.NewReader("x")); err == nil || err.msg != "not enough free disk space" {
+		t.Errorf("expected free space error, got %v", err)
+	}
+}
+
+func TestUploadGuardrails(t *testing.T) {
+	upload := func(t *testing.T, cfg *UploadConfig, query string, files map[string][]byte, fields ...string) (int, uploadResponse) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for name, content := range files {
+			part, _ := writer.CreateFormFile("file", name)
+			_, _ = part.Write(content)
+		}
+		for i := 0; i < len(fields); i += 2 {
+			_ = writer.WriteField(fields[i], fields[i+1])
+		}
+		writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/__upload"+query, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.TLS = withClientCert("alice")
+		rec := httptest.NewRecorder()
+		uploadHandler(cfg).ServeHTTP(rec, req)
+
+		var resp uploadResponse
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	sum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+
+	t.Run("reports checksum", func(t *testing.T) {
+		cfg := &UploadConfig{Dir: t.TempDir(), MaxBytes: 1 << 20}
+		status, resp := upload(t, cfg, "", map[string][]byte{"a.txt": []byte("hello")})
+		if status != http.StatusOK || resp.SHA256 != sum([]byte("hello")) {
+			t.Errorf("expected checksum %s, got %d %+v", sum([]byte("hello")), status, resp)
+		}
+	})
+
+	t.Run("checksum verified", func(t *testing.T) {
+		cfg := &UploadConfig{Dir: t.TempDir(), MaxBytes: 1 << 20}
+		status, _ := upload(t, cfg, "?sha256="+strings.ToUpper(sum([]byte("hello"))), map[string][]byte{"a.txt": []byte("hello")})
+		if status != http.StatusOK {
+			t.Errorf("expected 200 for matching checksum, got %d", status)
+		}
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		cfg := &UploadConfig{Dir: t.TempDir(), MaxBytes: 1 << 20}
+		status, resp := upload(t, cfg, "", map[string][]byte{"a.txt": []byte("hello")}, "sha256", sum([]byte("other")))
+		if status != http.StatusUnprocessableEntity || resp.Error != "checksum mismatch" {
+			t.Errorf("expected 422 checksum mismatch, got %d %q", status, resp.Error)
+		}
+		if entries, _ := os.ReadDir(cfg.Dir); len(entries) != 0 {
+			t.Errorf("mismatched upload should be removed, found %v", entries)
+		}
+	})
+
+	t.Run("type rules", func(t *testing.T) {
+		cfg := &UploadConfig{Dir: t.TempDir(), MaxBytes: 1 << 20, AllowExt: []string{".png"}, AllowMIME: []string{"image/*"}}
+		status, resp := upload(t, cfg, "", map[string][]byte{
+			"ok.png":   pngHeader,
+			"fake.png": []byte("MZ\x90\x00 not an image"),
+			"run.exe":  pngHeader,
+		})
+		if status != http.StatusMultiStatus {
+			t.Fatalf("expected 207, got %d", status)
+		}
+		errs := map[string]string{}
+		for _, f := range resp.Files {
+			errs[f.Filename] = f.Error
+		}
+		if errs["ok.png"] != "" || !strings.HasPrefix(errs["fake.png"], "content type not allowed") || errs["run.exe"] != "file type not allowed: .exe" {
+			t.Errorf("unexpected results: %+v", resp.Files)
+		}
+	})
+
+	t.Run("user quota", func(t *testing.T) {
+		cfg := &UploadConfig{Dir: t.TempDir(), MaxBytes: 1 << 20, UserQuota: 100}
+		status, _ := upload(t, cfg, "", map[string][]byte{"a.txt": bytes.Repeat([]byte("a"), 60)})
+		if status != http.StatusOK {
+			t.Fatalf("first upload: expected 200, got %d", status)
+		}
+		status, resp := upload(t, cfg, "", map[string][]byte{"b.txt": bytes.Repeat([]byte("b"), 60)})
+		if status != http.StatusInsufficientStorage || resp.Error != "upload quota exceeded" {
+			t.Errorf("second upload: expected 507 quota exceeded, got %d %q", status, resp.Error)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Dir, "b.txt")); err == nil {
+			t.Error("over-quota upload should not be saved")
+		}
+		if got := usageFor(cfg.Dir).get("alice"); got != 60 {
+			t.Errorf("expected ledger to record 60 bytes, got %d", got)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// visibility is the one policy for what dserve hides: root-level dotfiles
+// unless -dotfiles, dserve's own .dserve-* files, and anything matching a
+// -deny pattern. The file
+// server, web UI, archives, WebDAV, file management and live reload all
+// ask it, so a hidden file cannot leak through a side door. A nil
+// *visibility hides root dotfiles only.
+type visibility struct {
+	dotfiles bool
+	deny     []denyRule
+}
+
+// internalPrefix starts the names of dserve's own files, such as tus
+// staging and the upload usage ledger. They are hidden at every depth,
+// since the upload directory can be anywhere in the served tree.
+const internalPrefix = ".dserve-"
+
+// foldCase makes matching ignore case where the usual file systems do
+// (macOS, Windows): there ".ENV" and "Server.KEY" open the same files as
+// ".env" and "server.key", so a case-sensitive -deny would be bypassed.
+var foldCase = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// denyRule is one .gitignore-style pattern:
+//
+//	.env           any file or directory named .env, at any depth
+//	*.key          base names matching the glob, at any depth
+//	node_modules/  directories only
+//	/build         anchored to the root (so is any pattern with a "/")
+//	**/tmp         same as tmp
+//
+// A hidden directory hides everything below it. Negation ("!") is not
+// supported.
+type denyRule struct {
+	pattern  string
+	dirOnly  bool
+	anchored bool
+}
+
+func newVisibility(dotfiles bool, patterns []string) *visibility {
+	v := &visibility{dotfiles: dotfiles}
+	for _, p := range patterns {
+		if foldCase {
+			p = strings.ToLower(p)
+		}
+		var r denyRule
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		for strings.HasPrefix(p, "**/") {
+			p = strings.TrimPrefix(p, "**/")
+		}
+		if strings.Contains(p, "/") {
+			r.anchored = true
+			p = strings.TrimPrefix(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+		r.pattern = p
+		v.deny = append(v.deny, r)
+	}
+	return v
+}
+
+// validDenyPattern reports a malformed -deny pattern.
+func validDenyPattern(p string) error {
+	if _, err := path.Match(strings.Trim(p, "/"), ""); err != nil {
+		return fmt.Errorf("invalid deny pattern %q", p)
+	}
+	return nil
+}
+
+// hidden reports whether rel (slash-separated, relative to the served
+// directory) or any directory above it is hidden. isDir describes rel
+// itself.
+func (v *visibility) hidden(rel string, isDir bool) bool {
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	if rel == "" {
+		return false
+	}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && v.hiddenEntry(rel[:i], true) {
+			return true
+		}
+	}
+	return v.hiddenEntry(rel, isDir)
+}
+
+// hiddenEntry checks rel alone, for walkers that already checked the
+// directories above it.
+func (v *visibility) hiddenEntry(rel string, isDir bool) bool {
+	if rel == "" || rel == "." {
+		return false
+	}
+	if foldCase {
+		rel = strings.ToLower(rel)
+	}
+	base := path.Base(rel)
+	if strings.HasPrefix(base, internalPrefix) {
+		return true
+	}
+	if (v == nil || !v.dotfiles) && !strings.Contains(rel, "/") && strings.HasPrefix(rel, ".") {
+		return true
+	}
+	if v == nil {
+		return false
+	}
+	for _, r := range v.deny {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		name := base
+		if r.anchored {
+			name = rel
+		}
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint describes the policy, for cache keys of content it filters.
+func (v *visibility) fingerprint() string {
+	if v == nil {
+		return "default"
+	}
+	return fmt.Sprint(v.dotfiles, v.deny)
+}
+
+// hiddenPath is hidden for a path that may exist under root, using the
+// file system to tell directories from files.
+func (v *visibility) hiddenPath(root, rel string) bool {
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	info, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel)))
+	return v.hidden(rel, err == nil && info.IsDir())
+}
+
+// policyPrefix returns dir relative to root, slash-separated, so paths
+// under dir can be checked against the policy for root. A dir outside
+// root is treated as a root of its own.
+func policyPrefix(root, dir string) string {
+	absRoot, err1 := filepath.Abs(root)
+	absDir, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// hideMiddleware refuses requests for hidden paths.
+func hideMiddleware(next http.Handler, v *visibility, root string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v.hiddenPath(root, r.URL.Path) {
+			http.Error(w, "access to hidden files is forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// visibleFS wraps http.FileSystem to leave hidden entries out of
+// directory listings and refuse to open them.
+type visibleFS struct {
+	fs http.FileSystem
+	v  *visibility
+}
+
+func (vfs visibleFS) Open(name string) (http.File, error) {
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	f, err := vfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rel != "" {
+		info, err := f.Stat()
+		if err != nil || vfs.v.hidden(rel, info.IsDir()) {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+	}
+	return visibleFile{f, rel, vfs.v}, nil
+}
+
+type visibleFile struct {
+	http.File
+	rel string
+	v   *visibility
+}
+
+func (f visibleFile) Readdir(n int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(n)
+	filtered := files[:0]
+	for _, fi := range files {
+		if !f.v.hiddenEntry(path.Join(f.rel, fi.Name()), fi.IsDir()) {
+			filtered = append(filtered, fi)
+		}
+	}
+	return filtered, err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVisibilityHidden(t *testing.T) {
+	v := newVisibility(false, []string{".env", "*.key", "node_modules/", "/build", "**/tmp", "docs/private"})
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"", true, false},
+		{"index.html", false, false},
+		{".git", true, true},
+		{".git/config", false, true},
+		{"src/.eslintrc", false, false}, // only root dotfiles are hidden by default
+		{".env", false, true},
+		{"app/config/.env", false, true},
+		{"certs/server.key", false, true},
+		{"server.keys", false, false},
+		{"node_modules", true, true},
+		{"web/node_modules/react/index.js", false, true},
+		{"node_modules", false, false}, // a file of that name is not a directory
+		{"build", true, true},
+		{"build/app.js", false, true},
+		{"web/build", true, false}, // anchored to the root
+		{"tmp", true, true},
+		{"a/b/tmp/x", false, true},
+		{"docs/private", true, true},
+		{"docs/private/notes.md", false, true},
+		{"docs/public.md", false, false},
+		{".dserve-tus", true, true},
+		{"uploads/.dserve-usage.json", false, true}, // dserve's own files, at any depth
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			if got := v.hidden(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("hidden(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVisibilityDotfiles(t *testing.T) {
+	var none *visibility
+	if !none.hidden(".env", false) {
+		t.Error("a nil visibility should hide root dotfiles")
+	}
+	if newVisibility(true, nil).hidden(".env", false) {
+		t.Error("-dotfiles should show root dotfiles")
+	}
+	if !newVisibility(true, nil).hidden("uploads/.dserve-tus", true) {
+		t.Error("-dotfiles should not show dserve's own files")
+	}
+	if !newVisibility(true, []string{".env"}).hidden(".env", false) {
+		t.Error("-deny should hide a file even with -dotfiles")
+	}
+}
+
+func TestVisibilityFoldCase(t *testing.T) {
+	defer func(orig bool) { foldCase = orig }(foldCase)
+
+	foldCase = false
+	if newVisibility(false, []string{"*.key"}).hidden("Server.KEY", false) {
+		t.Error("matching should be case-sensitive on Linux")
+	}
+
+	foldCase = true
+	v := newVisibility(false, []string{"*.key", "Node_Modules/"})
+	for _, rel := range []string{"Server.KEY", "certs/server.Key", ".ENV", "uploads/.DSERVE-tus"} {
+		if !v.hidden(rel, false) {
+			t.Errorf("%s should be hidden on a case-insensitive file system", rel)
+		}
+	}
+	if !v.hidden("web/node_modules", true) {
+		t.Error("patterns should be folded too")
+	}
+}
+
+func TestValidDenyPattern(t *testing.T) {
+	for _, p := range []string{".env", "*.key", "node_modules/", "/build", "**/tmp"} {
+		if err := validDenyPattern(p); err != nil {
+			t.Errorf("validDenyPattern(%q): %v", p, err)
+		}
+	}
+	if err := validDenyPattern("[a-"); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func denyTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":              "home",
+		"app/.env":                "SECRET=1",
+		"app/main.go":             "package main",
+		"node_modules/x/index.js": "x",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFileServerDeny(t *testing.T) {
+	dir := denyTree(t)
+	v := newVisibility(false, []string{".env", "node_modules/"})
+	handler := hideMiddleware(http.FileServer(visibleFS{http.Dir(dir), v}), v, dir)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/", http.StatusOK},
+		{"/app/main.go", http.StatusOK},
+		{"/app/.env", http.StatusForbidden},
+		{"/node_modules/x/index.js", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/app/", nil))
+	if body := rec.Body.String(); strings.Contains(body, ".env") || !strings.Contains(body, "main.go") {
+		t.Errorf("listing should leave out .env: %s", body)
+	}
+}
+
+func TestUIHandlerDeny(t *testing.T) {
+	dir := denyTree(t)
+	handler := uiHandler(dir, uiOptions{Hide: newVisibility(false, []string{".env", "node_modules/"})})
+
+	req := httptest.NewRequest("GET", "/app/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var files []fileInfo
+	_ = json.NewDecoder(rec.Body).Decode(&files)
+	if len(files) != 1 || files[0].Name != "main.go" {
+		t.Errorf("expected only main.go, got %v", files)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/node_modules/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a denied directory, got %d", rec.Code)
+	}
+}
+
+func TestZipHandlerDeny(t *testing.T) {
+	dir := denyTree(t)
+	handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, newVisibility(false, []string{".env", "node_modules/"}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?path=/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	names := zipNames(t, rec.Body.Bytes())
+	if strings.Join(names, ",") != "app/main.go,index.html" {
+		t.Errorf("unexpected entries %v", names)
+	}
+}
+
+func TestLiveReloadDeny(t *testing.T) {
+	dir := denyTree(t)
+	lr, err := NewLiveReload("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	lr.hide = newVisibility(false, []string{".env"})
+	if err := lr.Watch(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !lr.hiddenPath(filepath.Join(dir, "app", ".env"), false) {
+		t.Error("changes to a denied file should not trigger a reload")
+	}
+	if lr.hiddenPath(filepath.Join(dir, "app", "main.go"), false) {
+		t.Error("changes to main.go should trigger a reload")
+	}
+}
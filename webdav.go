@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV (-webdav) mounts the served directory at /__dav/ so it can be
+// opened from Finder, Explorer or Nautilus. It is read-only unless uploads
+// are enabled; writes are then allowed inside the upload directory only,
+// and go through the same checks as /__upload.
+
+// davWriteMethods are the WebDAV methods that change the tree.
+var davWriteMethods = []string{
+	http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK",
+}
+
+// davIdentityMethods remove or rearrange existing files, so they need an
+// identity even when -upload-users is empty.
+var davIdentityMethods = []string{http.MethodDelete, "MKCOL", "COPY", "MOVE"}
+
+// davWriteState carries a write request's identity into davFS, and the
+// upload error back out, since the webdav package reports every failed
+// copy as 405.
+type davWriteState struct {
+	user    string
+	err     *uploadError
+	bodyErr error
+}
+
+type davWriteStateKey struct{}
+
+// errOutsideUpload refuses WebDAV writes outside the upload directory.
+var errOutsideUpload = &uploadError{http.StatusForbidden, "writes are only allowed in the upload directory"}
+
+// webdavHandler serves rootDir, writable under upload.Dir when uploads are
+// enabled and readOnly is false.
+func webdavHandler(rootDir string, upload *UploadConfig, readOnly bool, hide *visibility) http.Handler {
+	writable := upload != nil && !readOnly
+	fs := davFS{dir: webdav.Dir(rootDir), root: rootDir, hide: hide}
+	if writable {
+		fs.upload = upload
+		fs.uploadDir, _ = filepath.Abs(upload.Dir)
+	}
+	dav := &webdav.Handler{
+		Prefix:     "/__dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	var users []string
+	if upload != nil {
+		users = upload.Users
+	}
+	write := uploadPermission(dav, users)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(davWriteMethods, r.Method) {
+			dav.ServeHTTP(w, r)
+			return
+		}
+		if !writable {
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		user := requestIdentity(r)
+		if user == "" && slices.Contains(davIdentityMethods, r.Method) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dserve Basic Authentication"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPut && upload.MaxBytes > 0 && r.ContentLength > upload.MaxBytes {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		state := &davWriteState{user: user}
+		r = r.WithContext(context.WithValue(r.Context(), davWriteStateKey{}, state))
+		r.Body = &davBody{ReadCloser: r.Body, state: state}
+		write.ServeHTTP(&davWriteWriter{ResponseWriter: w, state: state}, r)
+	})
+}
+
+// davBody remembers a failed read, so a dropped PUT is not saved as a
+// short file.
+type davBody struct {
+	io.ReadCloser
+	state *davWriteState
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.state.bodyErr = err
+	}
+	return n, err
+}
+
+// davWriteWriter replaces the webdav package's 405 for a failed write with
+// the status of the upload check that failed.
+type davWriteWriter struct {
+	http.ResponseWriter
+	state *davWriteState
+}
+
+func (w *davWriteWriter) WriteHeader(code int) {
+	if code >= 400 && w.state.err != nil {
+		code = w.state.err.status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// davFS hides what the file server hides, keeps writes inside the upload
+// directory, and sends written files through the upload pipeline.
+type davFS struct {
+	dir       webdav.Dir
+	root      string
+	upload    *UploadConfig
+	uploadDir string // absolute upload.Dir
+	hide      *visibility
+}
+
+// hidden checks name, relative to root, against the policy.
+func (fs davFS) hidden(name string) bool {
+	return fs.hide.hiddenPath(fs.root, name)
+}
+
+// writable reports whether name is strictly inside the upload directory.
+func (fs davFS) writable(name string) bool {
+	abs, _, err := resolvePath(fs.root, name)
+	return err == nil && fs.upload != nil && abs != fs.uploadDir && withinDir(fs.uploadDir, abs)
+}
+
+// checkNewPath makes sure the segments of name that don't exist yet
+// survive safeFilename unchanged, like checkName for /__manage/, so
+// WebDAV cannot create names uploads would refuse.
+func (fs davFS) checkNewPath(name string) *uploadError {
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	dir := fs.root
+	for _, seg := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, seg)
+		if _, err := os.Lstat(dir); err == nil {
+			continue
+		}
+		if safeFilename(seg) != seg {
+			return &uploadError{http.StatusBadRequest, "invalid name: " + seg}
+		}
+	}
+	return nil
+}
+
+// refuse records uerr for davWriteWriter, since the webdav package would
+// report a status of its own.
+func refuse(ctx context.Context, uerr *uploadError) error {
+	if state, _ := ctx.Value(davWriteStateKey{}).(*davWriteState); state != nil {
+		state.err = uerr
+	}
+	return os.ErrPermission
+}
+
+func (fs davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if fs.hide.hidden(name, true) {
+		return os.ErrPermission
+	}
+	if !fs.writable(name) {
+		return refuse(ctx, errOutsideUpload)
+	}
+	if uerr := fs.checkNewPath(name); uerr != nil {
+		return refuse(ctx, uerr)
+	}
+	return fs.dir.Mkdir(ctx, name, perm)
+}
+
+func (fs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 && !fs.writable(name) {
+		return nil, refuse(ctx, errOutsideUpload)
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return fs.receive(ctx, name)
+	}
+	f, err := fs.dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return davDirFile{f, strings.Trim(path.Clean("/"+name), "/"), fs.hide}, nil
+}
+
+func (fs davFS) RemoveAll(ctx context.Context, name string) error {
+	if fs.hidden(name) {
+		return os.ErrNotExist
+	}
+	if !fs.writable(name) {
+		return refuse(ctx, errOutsideUpload)
+	}
+	return fs.dir.RemoveAll(ctx, name)
+}
+
+func (fs davFS) Rename(ctx context.Context, oldName, newName string) error {
+	info, err := fs.dir.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if fs.hidden(oldName) || fs.hide.hidden(newName, info.IsDir()) {
+		return os.ErrPermission
+	}
+	if !fs.writable(oldName) || !fs.writable(newName) {
+		return refuse(ctx, errOutsideUpload)
+	}
+	if uerr := fs.checkNewPath(newName); uerr != nil {
+		return refuse(ctx, uerr)
+	}
+	// A MOVE must not give a file a name its upload would have been
+	// refused for.
+	if !info.IsDir() {
+		if uerr := checkExtension(fs.upload, newName); uerr != nil {
+			return refuse(ctx, uerr)
+		}
+	}
+	return fs.dir.Rename(ctx, oldName, newName)
+}
+
+func (fs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.dir.Stat(ctx, name)
+}
+
+// receive starts an upload of name (a PUT, or the target of a COPY). The
+// body is piped into receiveFile as the webdav package writes it, and the
+// staged file is placed on Close, so type rules, quotas, free space, the
+// usage ledger and hooks all apply as for /__upload. The conflict policy
+// does not: saving over a file in a mounted share must replace it, so a
+// PUT always overwrites, keeping a backup with -upload-backup.
+func (fs davFS) receive(ctx context.Context, name string) (webdav.File, error) {
+	if fs.upload == nil {
+		return nil, os.ErrPermission
+	}
+	dest, _, err := resolvePath(fs.root, name)
+	if err != nil {
+		return nil, os.ErrPermission
+	}
+	rel, err := filepath.Rel(fs.uploadDir, dest)
+	if err != nil {
+		return nil, os.ErrPermission
+	}
+	rel = filepath.ToSlash(rel)
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		return nil, os.ErrPermission
+	}
+	if uerr := fs.checkNewPath(name); uerr != nil {
+		return nil, refuse(ctx, uerr)
+	}
+	// A PUT into a missing collection is a conflict (RFC 4918 9.7.1).
+	if fi, err := os.Stat(filepath.Dir(dest)); err != nil || !fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	state, _ := ctx.Value(davWriteStateKey{}).(*davWriteState)
+	if state == nil {
+		state = &davWriteState{}
+	}
+
+	pr, pw := io.Pipe()
+	u := &davUpload{cfg: fs.upload, name: path.Base(rel), pw: pw, state: state, done: make(chan struct{})}
+	go func() {
+		defer close(u.done)
+		var body io.Reader = pr
+		if fs.upload.MaxBytes > 0 {
+			body = http.MaxBytesReader(nil, pr, fs.upload.MaxBytes)
+		}
+		u.f, u.fatal = receiveFile(fs.upload, fs.upload.Dir, rel, state.user, 0, body)
+		switch {
+		case u.fatal != nil:
+			pr.CloseWithError(u.fatal)
+		case u.f.err != nil:
+			pr.CloseWithError(u.f.err)
+		default:
+			pr.Close()
+		}
+	}()
+	return u, nil
+}
+
+// davUpload is the webdav.File a PUT writes into.
+type davUpload struct {
+	cfg     *UploadConfig
+	name    string
+	pw      *io.PipeWriter
+	state   *davWriteState
+	done    chan struct{}
+	written int64
+
+	// Set by the receiving goroutine before done is closed.
+	f     *stagedFile
+	fatal *uploadError
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	n, err := u.pw.Write(p)
+	u.written += int64(n)
+	if err != nil {
+		<-u.done
+		u.state.err = u.failure()
+	}
+	return n, err
+}
+
+// failure is the check that stopped the upload, once done is closed.
+func (u *davUpload) failure() *uploadError {
+	if u.fatal != nil {
+		return u.fatal
+	}
+	return u.f.err
+}
+
+func (u *davUpload) Close() error {
+	if u.state.bodyErr != nil {
+		u.pw.CloseWithError(errBodyIncomplete)
+	} else {
+		u.pw.Close()
+	}
+	<-u.done
+	uerr := u.failure()
+	if uerr == nil {
+		uerr = u.f.commit(u.cfg, "", conflictOverwrite)
+	}
+	if u.f != nil && u.f.tmp != "" {
+		os.Remove(u.f.tmp)
+	}
+	if uerr != nil {
+		u.state.err = uerr
+		return uerr
+	}
+	if u.f.skipped {
+		return nil
+	}
+	if countsUsage(u.cfg) {
+		usageFor(u.cfg.Dir).add(u.state.user, u.f.size)
+	}
+	fireUploadHooks(u.cfg, newUploadEvent(u.f.result(u.cfg.Dir), u.state.user))
+	return nil
+}
+
+func (u *davUpload) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return u.written, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (u *davUpload) Readdir(n int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return davUploadInfo{name: u.name, size: u.written}, nil
+}
+
+// davUploadInfo describes an upload still being written.
+type davUploadInfo struct {
+	name string
+	size int64
+}
+
+func (fi davUploadInfo) Name() string       { return fi.name }
+func (fi davUploadInfo) Size() int64        { return fi.size }
+func (fi davUploadInfo) Mode() os.FileMode  { return 0644 }
+func (fi davUploadInfo) ModTime() time.Time { return time.Now() }
+func (fi davUploadInfo) IsDir() bool        { return false }
+func (fi davUploadInfo) Sys() any           { return nil }
+
+// davDirFile leaves hidden entries out of directory listings.
+type davDirFile struct {
+	webdav.File
+	rel  string
+	hide *visibility
+}
+
+func (f davDirFile) Readdir(n int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(n)
+	filtered := files[:0]
+	for _, fi := range files {
+		if !f.hide.hiddenEntry(path.Join(f.rel, fi.Name()), fi.IsDir()) {
+			filtered = append(filtered, fi)
+		}
+	}
+	return filtered, err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func davRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+	}
+	return req
+}
+
+func TestWebDAVRead(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "sub", ".keep"), []byte(""), 0644)
+
+	handler := webdavHandler(dir, nil, false, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("GET", "/__dav/a.txt", ""))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("GET = %d %q, want 200 hello", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PROPFIND", "/__dav/", ""))
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND = %d, want 207", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "a.txt") || !strings.Contains(body, "sub") {
+		t.Errorf("listing missing entries: %s", body)
+	}
+	if strings.Contains(body, ".env") {
+		t.Error("listing should hide root dotfiles")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("GET", "/__dav/.env", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET root dotfile = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PROPFIND", "/__dav/sub/", ""))
+	if !strings.Contains(rec.Body.String(), ".keep") {
+		t.Error("nested dotfiles should stay visible, as in the file server")
+	}
+
+	rec = httptest.NewRecorder()
+	webdavHandler(dir, nil, false, newVisibility(true, nil)).ServeHTTP(rec, davRequest("GET", "/__dav/.env", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET root dotfile with -dotfiles = %d, want 200", rec.Code)
+	}
+}
+
+func TestWebDAVReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+
+	tests := []struct {
+		name     string
+		upload   *UploadConfig
+		readOnly bool
+	}{
+		{"without -upload", nil, false},
+		{"with -webdav-readonly", &UploadConfig{Dir: dir}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := webdavHandler(dir, tt.upload, tt.readOnly, nil)
+			for _, method := range []string{"PUT", "DELETE", "MKCOL", "MOVE"} {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, davRequest(method, "/__dav/a.txt", "changed"))
+				if rec.Code != http.StatusMethodNotAllowed {
+					t.Errorf("%s = %d, want 405", method, rec.Code)
+				}
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "hello" {
+				t.Errorf("file changed to %q", data)
+			}
+		})
+	}
+}
+
+func TestWebDAVWrite(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	handler := webdavHandler(dir, &UploadConfig{Dir: dir, MaxBytes: 10}, false, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PUT", "/__dav/new.txt", "new"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d, want 201", rec.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "new.txt")); string(data) != "new" {
+		t.Errorf("new.txt = %q", data)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PUT", "/__dav/a.txt", "way too large"))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized PUT = %d, want 413", rec.Code)
+	}
+
+	// Without Content-Length the limit is enforced while copying.
+	req := davRequest("PUT", "/__dav/a.txt", "")
+	req.Body = io.NopCloser(strings.NewReader("way too large"))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunked PUT = %d, want 413", rec.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "hello" {
+		t.Errorf("failed PUT replaced a.txt with %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".dserve-upload-") {
+			t.Errorf("staging file %s left behind", e.Name())
+		}
+	}
+
+	req = davRequest("MKCOL", "/__dav/docs", "")
+	req.TLS = withClientCert("alice")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("MKCOL = %d, want 201", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PUT", "/__dav/.env", "x"))
+	if rec.Code == http.StatusCreated {
+		t.Error("PUT to a root dotfile should be refused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".env")); err == nil {
+		t.Error(".env should not have been created")
+	}
+}
+
+func TestWebDAVWriteUsers(t *testing.T) {
+	dir := t.TempDir()
+	handler := webdavHandler(dir, &UploadConfig{Dir: dir, Users: []string{"alice"}}, false, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PUT", "/__dav/a.txt", "x"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous PUT = %d, want 401", rec.Code)
+	}
+
+	req := davRequest("PUT", "/__dav/a.txt", "x")
+	req.TLS = withClientCert("alice")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("PUT as alice = %d, want 201", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("PROPFIND", "/__dav/", ""))
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("anonymous PROPFIND = %d, want 207", rec.Code)
+	}
+}
+
+func TestWebDAVUploadPipeline(t *testing.T) {
+	root := t.TempDir()
+	inbox := filepath.Join(root, "inbox")
+	_ = os.Mkdir(inbox, 0755)
+	_ = os.WriteFile(filepath.Join(root, "secret.txt"), []byte("served, not writable"), 0644)
+	_ = os.WriteFile(filepath.Join(inbox, "a.txt"), []byte("old"), 0644)
+	cfg := &UploadConfig{Dir: inbox, MaxBytes: 1024, DenyExt: []string{".exe"}, UserQuota: 10}
+	handler := webdavHandler(root, cfg, false, newVisibility(false, []string{"/inbox/private"}))
+
+	put := func(target, body string) int {
+		req := davRequest("PUT", target, body)
+		req.TLS = withClientCert("alice")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, davRequest("GET", "/__dav/secret.txt", ""))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET outside the upload directory = %d, want 200", rec.Code)
+	}
+	if code := put("/__dav/secret.txt", "changed"); code != http.StatusForbidden {
+		t.Errorf("PUT outside the upload directory = %d, want 403", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "secret.txt")); string(data) != "served, not writable" {
+		t.Errorf("secret.txt changed to %q", data)
+	}
+	for _, tt := range []struct{ method, target, dest string }{
+		{"MKCOL", "/__dav/docs", ""},
+		{"DELETE", "/__dav/secret.txt", ""},
+		{"DELETE", "/__dav/inbox", ""},
+		{"MOVE", "/__dav/secret.txt", "/__dav/inbox/secret.txt"},
+		{"MOVE", "/__dav/inbox/a.txt", "/__dav/a.txt"},
+	} {
+		req := davRequest(tt.method, tt.target, "")
+		req.TLS = withClientCert("alice")
+		if tt.dest != "" {
+			req.Header.Set("Destination", tt.dest)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s outside the upload directory = %d, want 403", tt.method, tt.target, rec.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "a.txt")); err != nil {
+		t.Error("a.txt should not have moved out of the upload directory")
+	}
+
+	if code := put("/__dav/inbox/run.exe", "MZ"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("denied extension = %d, want 415", code)
+	}
+	if code := put("/__dav/inbox/a.txt", "new"); code != http.StatusCreated {
+		t.Errorf("PUT over an existing file = %d, want 201", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(inbox, "a.txt")); string(data) != "new" {
+		t.Errorf("PUT should replace a.txt, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "a_1.txt")); err == nil {
+		t.Error("PUT should not save a renamed copy")
+	}
+
+	// Finder locks a new file, which creates it empty, then saves into it.
+	lock := davRequest("LOCK", "/__dav/inbox/b.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`)
+	lock.TLS = withClientCert("alice")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, lock)
+	if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+		t.Fatalf("LOCK = %d", rec.Code)
+	}
+	req := davRequest("PUT", "/__dav/inbox/b.txt", "b")
+	req.TLS = withClientCert("alice")
+	req.Header.Set("If", "("+rec.Header().Get("Lock-Token")+")")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("PUT into a locked file = %d, want 201", rec.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(inbox, "b.txt")); string(data) != "b" {
+		t.Errorf("b.txt = %q, want b", data)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "b_1.txt")); err == nil {
+		t.Error("saving into a locked file should not leave a renamed copy")
+	}
+
+	if got := usageFor(inbox).get("alice"); got != 4 {
+		t.Errorf("ledger recorded %d bytes, want 4", got)
+	}
+	if code := put("/__dav/inbox/c.txt", "over the quota"); code != http.StatusInsufficientStorage {
+		t.Errorf("over quota = %d, want 507", code)
+	}
+	_ = os.Mkdir(filepath.Join(inbox, "private"), 0755)
+	if code := put("/__dav/inbox/private/x.txt", "x"); code == http.StatusCreated {
+		t.Error("PUT into a denied directory should be refused")
+	}
+
+	for _, tt := range []struct {
+		method, target, dest string
+		want                 int
+	}{
+		{"MOVE", "/__dav/inbox/a.txt", "/__dav/inbox/a.exe", http.StatusUnsupportedMediaType},
+		{"COPY", "/__dav/inbox/a.txt", "/__dav/inbox/a.exe", http.StatusUnsupportedMediaType},
+		{"MKCOL", "/__dav/inbox/con", "", http.StatusBadRequest},
+		{"MOVE", "/__dav/inbox/a.txt", "/__dav/inbox/a:b.txt", http.StatusBadRequest},
+		{"PUT", "/__dav/inbox/lpt1.txt", "", http.StatusBadRequest},
+	} {
+		req := davRequest(tt.method, tt.target, "")
+		req.TLS = withClientCert("alice")
+		if tt.dest != "" {
+			req.Header.Set("Destination", tt.dest)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s %s = %d, want %d", tt.method, tt.target, tt.dest, rec.Code, tt.want)
+		}
+	}
+	for _, name := range []string{"a.exe", "con", "a:b.txt", "lpt1.txt"} {
+		if _, err := os.Lstat(filepath.Join(inbox, name)); err == nil {
+			t.Errorf("%s should not have been created", name)
+		}
+	}
+
+	for _, method := range []string{"DELETE", "MKCOL", "MOVE", "COPY"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, davRequest(method, "/__dav/inbox/a.txt", ""))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s = %d, want 401", method, rec.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "a.txt")); err != nil {
+		t.Error("anonymous DELETE removed a.txt")
+	}
+}
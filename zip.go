@@ -2,124 +2,351 @@ package main
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"encoding/json"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func zipHandler(rootDir string) http.Handler {
+// maxSelectionBytes caps the form body of a selective archive request.
+const maxSelectionBytes = 1 << 20
+
+// zipHandler serves GET /__zip?path=/dir for a whole directory, and
+// POST /__zip with repeated "path" fields for a selection of files and
+// directories. Both accept format, include and exclude, and estimate=1
+// to get the archive's size as JSON instead of the archive. With
+// ZipConfig.CacheBytes set, archives are built on disk first and served
+// with Range support.
+func zipHandler(rootDir string, cfg *ZipConfig, hide *visibility) http.Handler {
+	limiter := newArchiveLimiter(cfg)
+	// Estimates are cheap next to archives but still walk the tree, so
+	// they get a budget of their own rather than using up downloads.
+	estimates := newArchiveLimiter(cfg)
+	var cache *archiveCache
+	if cfg.CacheBytes > 0 {
+		cache = newArchiveCache(cfg.CacheDir, cfg.CacheBytes)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqPath := r.URL.Query().Get("path")
-		if reqPath == "" {
-			reqPath = "/"
+		var sources []archiveSource
+		var dirName string
+		var aerr *archiveError
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sources, dirName, aerr = directorySource(rootDir, r.URL.Query().Get("path"), hide)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxSelectionBytes)
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "invalid form", http.StatusBadRequest)
+				return
+			}
+			sources, dirName, aerr = selectionSources(rootDir, r.PostForm["path"], hide)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if aerr != nil {
+			http.Error(w, aerr.msg, aerr.status)
+			return
 		}
 
-		// Normalize URL path to prevent directory traversal
-		cleanURLPath := path.Clean("/" + reqPath)
-		relPath := strings.TrimPrefix(cleanURLPath, "/")
-		fullPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-
-		absRoot, err := filepath.Abs(rootDir)
-		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
+		format, ok := archiveFormats[r.FormValue("format")]
+		if !ok {
+			http.Error(w, "unsupported format", http.StatusBadRequest)
 			return
 		}
-		absPath, err := filepath.Abs(fullPath)
+		filter, err := newArchiveFilter(r.Form["include"], r.Form["exclude"])
 		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Validate path is within root using filepath.Rel
-		rel, err := filepath.Rel(absRoot, absPath)
-		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
+		absRoot, _ := filepath.Abs(rootDir)
+		spec := archiveSpec{
+			root:     absRoot,
+			sources:  sources,
+			filter:   filter,
+			level:    cfg.Level,
+			symlinks: cfg.Symlinks,
+			hide:     hide,
+		}.withSymlinks(format.ext)
+		estimate := r.FormValue("estimate") != ""
 
-		info, err := os.Stat(fullPath)
-		if os.IsNotExist(err) {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
+		allowed := func(budget *archiveLimiter) bool {
+			ok, wait := budget.allow(archiveClient(r), time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+				http.Error(w, "too many archive downloads, try again later", http.StatusTooManyRequests)
+			}
+			return ok
 		}
-		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
+		// Resuming a cached download is not a new archive. The If-Range
+		// ETag only vouches for that; the check is redone below once the
+		// archive's own key is known.
+		resume := cache != nil && !estimate && r.Header.Get("Range") != "" &&
+			cache.has(ifRangeKey(r, format.ext))
+		budget := limiter
+		if estimate {
+			budget = estimates
+		}
+		if !resume && !allowed(budget) {
 			return
 		}
-		if !info.IsDir() {
-			http.Error(w, "not a directory", http.StatusBadRequest)
+		if !limiter.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "too many archive downloads in progress", http.StatusServiceUnavailable)
 			return
 		}
+		var once sync.Once
+		release := func() { once.Do(limiter.release) }
+		defer release()
 
-		dirName := filepath.Base(absPath)
-		if dirName == "." || dirName == "/" {
+		var size archiveSize
+		if estimate || cfg.MaxFiles > 0 || cfg.MaxBytes > 0 || cache != nil {
+			size, err = measureArchive(spec, cfg)
+			if err != nil {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if estimate {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(size)
+				return
+			}
+			if size.TooLarge {
+				aerr := size.limitError()
+				http.Error(w, aerr.msg, aerr.status)
+				return
+			}
+		}
+
+		// Content alone larger than the cache can't fit, so don't try.
+		useCache := cache != nil && size.Bytes <= cache.maxBytes
+		var key string
+		if cache != nil {
+			key = archiveKey(spec, format.ext, r.Form["include"], r.Form["exclude"], size)
+			if resume && !cache.has(key) && !allowed(limiter) {
+				return
+			}
+		}
+
+		if dirName == "." || dirName == "/" || dirName == "" {
 			dirName = "download"
 		}
-		w.Header().Set("Content-Type", "application/zip")
-		w.Header().Set("Content-Disposition", `attachment; filename="`+dirName+`.zip"`)
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+dirName+format.ext+`"`)
 
-		if err := zipDirectory(w, absPath, absRoot); err != nil {
+		if useCache && serveCachedArchive(w, r, cache, key, format, spec, size.modified, release) {
+			return
+		}
+
+		// A client that stops reading must not keep the job slot: every
+		// write gets archiveIdleTimeout to go through.
+		rc := http.NewResponseController(w)
+		skipped, err := format.write(&idleWriter{w: w, rc: rc, timeout: archiveIdleTimeout}, spec)
+		_ = rc.SetWriteDeadline(time.Time{})
+		logSkipped(w, r, skipped)
+		if err != nil {
 			// Headers already sent, can't change status. Log for debugging.
-			log.Printf("zip write error for %s: %v", absPath, err)
+			log.Printf("%s write error for %s: %v", strings.TrimPrefix(format.ext, "."), r.URL.Path, err)
 			return
 		}
 	})
 }
 
-func zipDirectory(w io.Writer, dir string, root string) error {
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+// ifRangeKey is the cache key named by a request's If-Range ETag, or ""
+// without one.
+func ifRangeKey(r *http.Request, ext string) string {
+	tag := r.Header.Get("If-Range")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return ""
+	}
+	return tag[1:len(tag)-1] + ext
+}
+
+type archiveError struct {
+	status int
+	msg    string
+}
 
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+var (
+	errArchiveForbidden = &archiveError{http.StatusForbidden, "forbidden"}
+	errArchiveNotFound  = &archiveError{http.StatusNotFound, "not found"}
+	errArchiveInternal  = &archiveError{http.StatusInternalServerError, "internal error"}
+)
+
+// logSkipped reports entries left out of an archive: read errors are
+// logged one by one, and the count goes on the access log line.
+func logSkipped(w http.ResponseWriter, r *http.Request, skipped []skippedEntry) {
+	if len(skipped) == 0 {
+		return
+	}
+	for _, s := range skipped {
+		if s.err {
+			log.Printf("archive %s: skipped %s: %s", r.URL.Path, s.name, s.reason)
+		}
+	}
+	addLogNote(w, "skipped="+strconv.Itoa(len(skipped)))
+}
+
+// directorySource resolves the ?path= of a whole-directory download.
+func directorySource(rootDir, reqPath string, hide *visibility) ([]archiveSource, string, *archiveError) {
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	absPath, rel, err := resolvePath(rootDir, reqPath)
+	if err == errOutsideRoot {
+		return nil, "", errArchiveForbidden
+	}
+	if err != nil {
+		return nil, "", errArchiveInternal
+	}
+
+	info, err := os.Stat(absPath)
+	if os.IsNotExist(err) {
+		return nil, "", errArchiveNotFound
+	}
+	if err != nil {
+		return nil, "", errArchiveInternal
+	}
+	if hide.hidden(rel, info.IsDir()) {
+		return nil, "", errArchiveNotFound
+	}
+	if !info.IsDir() {
+		return nil, "", &archiveError{http.StatusBadRequest, "not a directory"}
+	}
+	return []archiveSource{{path: absPath}}, filepath.Base(absPath), nil
+}
+
+// selectionSources resolves each selected path with the same root checks
+// as a directory download. Entries are named relative to the deepest
+// directory the selection shares, so picking files in one listing gives
+// a flat archive.
+func selectionSources(rootDir string, paths []string, hide *visibility) ([]archiveSource, string, *archiveError) {
+	if len(paths) == 0 {
+		return nil, "", &archiveError{http.StatusBadRequest, "no paths selected"}
+	}
+
+	rels := make([]string, 0, len(paths))
+	abss := make([]string, 0, len(paths))
+	for _, p := range paths {
+		absPath, rel, err := resolvePath(rootDir, p)
+		if err == errOutsideRoot {
+			return nil, "", errArchiveForbidden
+		}
 		if err != nil {
-			return nil
+			return nil, "", errArchiveInternal
+		}
+		if rel == "" {
+			return nil, "", &archiveError{http.StatusBadRequest, "use GET to download the root directory"}
 		}
+		info, err := os.Lstat(absPath)
+		if err != nil || hide.hidden(rel, info.IsDir()) {
+			return nil, "", errArchiveNotFound
+		}
+		rels = append(rels, rel)
+		abss = append(abss, absPath)
+	}
 
-		if info.IsDir() {
-			relToRoot, _ := filepath.Rel(root, path)
-			base := filepath.Base(path)
-			if base != "." && strings.HasPrefix(base, ".") && filepath.Dir(relToRoot) == "." {
-				return filepath.SkipDir
-			}
-			return nil
+	parent := path.Dir(rels[0])
+	for _, rel := range rels[1:] {
+		for parent != "." && !strings.HasPrefix(rel, parent+"/") {
+			parent = path.Dir(parent)
 		}
+	}
 
-		relToRoot, _ := filepath.Rel(root, path)
-		base := filepath.Base(path)
-		if strings.HasPrefix(base, ".") && filepath.Dir(relToRoot) == "." {
-			return nil
+	sources := make([]archiveSource, len(rels))
+	seen := map[string]bool{}
+	for i, rel := range rels {
+		name := rel
+		if parent != "." {
+			name = strings.TrimPrefix(rel, parent+"/")
 		}
+		if seen[name] {
+			return nil, "", &archiveError{http.StatusBadRequest, "duplicate path " + name}
+		}
+		seen[name] = true
+		sources[i] = archiveSource{path: abss[i], name: name}
+	}
+	return sources, path.Base(parent), nil
+}
 
-		relToDir, err := filepath.Rel(dir, path)
-		if err != nil {
+// zipArchive streams spec as a zip. Already-compressed files such as
+// videos, images and archives are stored rather than deflated again.
+// Stored symlinks follow the Info-ZIP convention: a symlink mode with the
+// target as the entry's content.
+func zipArchive(w io.Writer, spec archiveSpec) ([]skippedEntry, error) {
+	spec = spec.withSymlinks(".zip")
+	zw := zip.NewWriter(w)
+	if spec.level != flate.DefaultCompression {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, spec.level)
+		})
+	}
+
+	skipped, err := walkArchive(spec, func(e archiveEntry) error {
+		if e.info.IsDir() {
 			return nil
 		}
 
-		header, err := zip.FileInfoHeader(info)
+		header, err := zip.FileInfoHeader(e.info)
 		if err != nil {
-			return nil
+			return &entrySkip{err.Error()}
 		}
-		header.Name = filepath.ToSlash(relToDir)
+		header.Name = e.name
 		header.Method = zip.Deflate
+		if spec.level == flate.NoCompression || isCompressedFile(e.name) {
+			header.Method = zip.Store
+		}
 
-		writer, err := zw.CreateHeader(header)
-		if err != nil {
-			return nil
+		if e.link != "" {
+			header.Method = zip.Store
+			writer, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(writer, e.link)
+			return err
 		}
 
-		file, err := os.Open(path)
+		file, err := os.Open(e.path)
 		if err != nil {
-			return nil
+			return &entrySkip{"cannot read: " + errReason(err)}
 		}
 		defer file.Close()
 
-		if _, err := io.Copy(writer, file); err != nil {
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
 			return err
 		}
+		src := &readTracker{r: file}
+		if _, err := io.Copy(writer, src); err != nil {
+			if src.err == nil {
+				return err // the client went away
+			}
+			return &entrySkip{truncatedReason(src.err)}
+		}
 		return nil
 	})
+	if err != nil {
+		return skipped, err
+	}
+	if len(skipped) > 0 {
+		writer, err := zw.CreateHeader(&zip.FileHeader{Name: archiveManifestName, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return skipped, err
+		}
+		if _, err := writer.Write(manifest(skipped)); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, zw.Close()
 }
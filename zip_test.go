@@ -3,11 +3,16 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"net/url"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -20,7 +25,7 @@ func TestZipHandler(t *testing.T) {
 	_ = os.WriteFile(filepath.Join(subDir, "file2.txt"), []byte("content2"), 0644)
 	_ = os.WriteFile(filepath.Join(tmpDir, ".hidden"), []byte("hidden"), 0644)
 
-	handler := zipHandler(tmpDir)
+	handler := zipHandler(tmpDir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil)
 
 	tests := []struct {
 		name       string
@@ -94,7 +99,7 @@ func TestZipDotfileExclusion(t *testing.T) {
 	_ = os.Mkdir(hiddenDir, 0755)
 	_ = os.WriteFile(filepath.Join(hiddenDir, "secret.txt"), []byte("secret"), 0644)
 
-	handler := zipHandler(tmpDir)
+	handler := zipHandler(tmpDir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil)
 
 	req := httptest.NewRequest("GET", "/__zip", nil)
 	rec := httptest.NewRecorder()
@@ -135,7 +140,7 @@ func TestZipDirectoryContents(t *testing.T) {
 	_ = os.WriteFile(filepath.Join(tmpDir, "root.txt"), []byte("root content"), 0644)
 	_ = os.WriteFile(filepath.Join(subDir, "nested.txt"), []byte("nested content"), 0644)
 
-	handler := zipHandler(tmpDir)
+	handler := zipHandler(tmpDir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil)
 
 	req := httptest.NewRequest("GET", "/__zip", nil)
 	rec := httptest.NewRecorder()
@@ -173,3 +178,263 @@ func TestZipDirectoryContents(t *testing.T) {
 		t.Errorf("missing file in zip: %s", name)
 	}
 }
+
+func zipNames(t *testing.T, body []byte) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestZipHandlerSelection(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "docs", "img"), 0755)
+	_ = os.MkdirAll(filepath.Join(dir, "src"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "a.md"), []byte("a"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "b.md"), []byte("b"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "debug.log"), []byte("log"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "img", "x.png"), []byte("png"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("go"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil)
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		wantFiles  []string
+		wantName   string
+	}{
+		{
+			name:       "files in one listing",
+			form:       url.Values{"path": {"/docs/a.md", "/docs/b.md"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"a.md", "b.md"},
+			wantName:   "docs.zip",
+		},
+		{
+			name:       "file and folder",
+			form:       url.Values{"path": {"/docs/a.md", "/docs/img"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"a.md", "img/x.png"},
+		},
+		{
+			name:       "across directories",
+			form:       url.Values{"path": {"/docs/a.md", "/src"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"docs/a.md", "src/main.go"},
+			wantName:   "download.zip",
+		},
+		{
+			name:       "exclude pattern",
+			form:       url.Values{"path": {"/docs"}, "exclude": {"*.log,img/"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"docs/a.md", "docs/b.md"},
+		},
+		{
+			name:       "include pattern",
+			form:       url.Values{"path": {"/docs", "/src"}, "include": {"*.md"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"docs/a.md", "docs/b.md"},
+		},
+		{
+			name:       "traversal stays in root",
+			form:       url.Values{"path": {"../../docs/a.md"}},
+			wantStatus: http.StatusOK,
+			wantFiles:  []string{"a.md"},
+		},
+		{"no paths", url.Values{}, http.StatusBadRequest, nil, ""},
+		{"missing path", url.Values{"path": {"/nope"}}, http.StatusNotFound, nil, ""},
+		{"root dotfile", url.Values{"path": {"/.env"}}, http.StatusNotFound, nil, ""},
+		{"root itself", url.Values{"path": {"/"}}, http.StatusBadRequest, nil, ""},
+		{"duplicate", url.Values{"path": {"/docs/a.md", "/docs/a.md"}}, http.StatusBadRequest, nil, ""},
+		{"bad pattern", url.Values{"path": {"/docs"}, "include": {"[a"}}, http.StatusBadRequest, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/__zip", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := zipNames(t, rec.Body.Bytes()); !slices.Equal(got, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", got, tt.wantFiles)
+			}
+			if tt.wantName != "" {
+				want := `attachment; filename="` + tt.wantName + `"`
+				if cd := rec.Header().Get("Content-Disposition"); cd != want {
+					t.Errorf("Content-Disposition = %q, want %q", cd, want)
+				}
+			}
+		})
+	}
+}
+
+func TestZipHandlerFilterOnGet(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "b.log"), []byte("b"), 0644)
+
+	rec := httptest.NewRecorder()
+	zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow}, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?exclude=*.log", nil))
+
+	if got := zipNames(t, rec.Body.Bytes()); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("files = %v, want [a.txt]", got)
+	}
+}
+
+func TestZipArchiveMethods(t *testing.T) {
+	dir := t.TempDir()
+	text := bytes.Repeat([]byte("hello dserve "), 1000)
+	_ = os.WriteFile(filepath.Join(dir, "notes.txt"), text, 0644)
+	_ = os.WriteFile(filepath.Join(dir, "clip.mp4"), text, 0644)
+	_ = os.WriteFile(filepath.Join(dir, "bundle.zip"), text, 0644)
+
+	tests := []struct {
+		name  string
+		level int
+		want  map[string]uint16
+	}{
+		{"default", flate.DefaultCompression, map[string]uint16{"notes.txt": zip.Deflate, "clip.mp4": zip.Store, "bundle.zip": zip.Store}},
+		{"fastest", flate.BestSpeed, map[string]uint16{"notes.txt": zip.Deflate, "clip.mp4": zip.Store}},
+		{"store only", flate.NoCompression, map[string]uint16{"notes.txt": zip.Store, "clip.mp4": zip.Store}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			spec := archiveSpec{root: dir, sources: []archiveSource{{path: dir}}, level: tt.level}
+			if _, err := zipArchive(&buf, spec); err != nil {
+				t.Fatalf("zipArchive: %v", err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("invalid zip: %v", err)
+			}
+			for _, f := range zr.File {
+				if want, ok := tt.want[f.Name]; ok && f.Method != want {
+					t.Errorf("%s method = %d, want %d", f.Name, f.Method, want)
+				}
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatalf("open %s: %v", f.Name, err)
+				}
+				data, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil || !bytes.Equal(data, text) {
+					t.Errorf("%s content mismatch (err %v)", f.Name, err)
+				}
+			}
+		})
+	}
+}
+
+// tailWriter counts everything written but keeps only the last max to
+// 2*max bytes, which is where the zip central directory and Zip64
+// records live.
+type tailWriter struct {
+	size int64
+	tail []byte
+	max  int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > 2*w.max {
+		w.tail = append(w.tail[:0], w.tail[len(w.tail)-w.max:]...)
+	}
+	return len(p), nil
+}
+
+// ReadAt serves the kept tail and zeros before it; zip.NewReader only
+// reads the directory at the end.
+func (w *tailWriter) ReadAt(p []byte, off int64) (int, error) {
+	start := w.size - int64(len(w.tail))
+	for i := range p {
+		pos := off + int64(i)
+		if pos >= w.size {
+			return i, io.EOF
+		}
+		if pos >= start {
+			p[i] = w.tail[pos-start]
+		} else {
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func TestZipArchiveZip64(t *testing.T) {
+	// Too slow for every run, and CI runs without -short.
+	if os.Getenv("DSERVE_ZIP64_TEST") == "" {
+		t.Skip("writes a 4GB+ archive and 70k entries; set DSERVE_ZIP64_TEST=1 to run")
+	}
+
+	dir := t.TempDir()
+	const bigSize = 4<<30 + 1<<20
+	big, err := os.Create(filepath.Join(dir, "big.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A sparse file: no disk space needed, and .mp4 is stored so no
+	// time goes into deflating zeros.
+	if err := big.Truncate(bigSize); err != nil {
+		big.Close()
+		t.Skipf("sparse files unsupported: %v", err)
+	}
+	big.Close()
+
+	const entries = 70000
+	many := filepath.Join(dir, "many")
+	_ = os.Mkdir(many, 0755)
+	for i := range entries {
+		if err := os.WriteFile(filepath.Join(many, strconv.Itoa(i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &tailWriter{max: 16 << 20}
+	spec := archiveSpec{root: dir, sources: []archiveSource{{path: dir}}, level: flate.DefaultCompression}
+	if _, err := zipArchive(w, spec); err != nil {
+		t.Fatalf("zipArchive: %v", err)
+	}
+	if w.size <= 1<<32 {
+		t.Fatalf("archive is %d bytes, want over 4GB", w.size)
+	}
+
+	zr, err := zip.NewReader(w, w.size)
+	if err != nil {
+		t.Fatalf("reading Zip64 directory: %v", err)
+	}
+	if len(zr.File) != entries+1 {
+		t.Errorf("entries = %d, want %d", len(zr.File), entries+1)
+	}
+	var found bool
+	for _, f := range zr.File {
+		if f.Name == "big.mp4" {
+			found = true
+			if f.UncompressedSize64 != bigSize || f.CompressedSize64 != bigSize {
+				t.Errorf("big.mp4 sizes = %d/%d, want %d", f.CompressedSize64, f.UncompressedSize64, bigSize)
+			}
+		}
+	}
+	if !found {
+		t.Error("big.mp4 missing from archive")
+	}
+}
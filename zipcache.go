@@ -0,0 +1,277 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveCache keeps built archives on disk so they can be served with
+// Content-Length, an ETag and Range requests, letting a dropped download
+// of a large folder resume. Archives are keyed by what goes into them
+// and the newest mtime of their contents, so any change builds a fresh
+// one. The least recently used archives are removed to stay under
+// maxBytes.
+type archiveCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List // of *cachedArchive, most recently used first
+	entries  map[string]*list.Element
+	total    int64
+	building map[string]*archiveBuild
+}
+
+type cachedArchive struct {
+	key     string
+	path    string
+	size    int64
+	skipped []skippedEntry
+}
+
+// archiveBuild lets concurrent requests for the same archive wait for a
+// single build.
+type archiveBuild struct {
+	done  chan struct{}
+	entry *cachedArchive
+	err   error
+}
+
+// errCacheTooSmall stops a build that would not fit in the cache at all.
+var errCacheTooSmall = errors.New("archive larger than the cache")
+
+// cacheFilePrefix marks the files archiveCache owns in its directory.
+const cacheFilePrefix = "dserve-"
+
+// defaultCacheDir is where archives are cached without -zip-cache-dir.
+var defaultCacheDir = func() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || dir == "" {
+		return filepath.Join(os.TempDir(), "dserve-archives")
+	}
+	return filepath.Join(dir, "dserve", "archives")
+}
+
+// newArchiveCache indexes archives left in dir by an earlier run, oldest
+// first, so they count toward maxBytes and can be reused.
+func newArchiveCache(dir string, maxBytes int64) *archiveCache {
+	c := &archiveCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		building: map[string]*archiveBuild{},
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return c
+	}
+	type found struct {
+		entry   *cachedArchive
+		modTime time.Time
+	}
+	var existing []found
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, cacheFilePrefix) || f.IsDir() {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(p) // an interrupted build
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		key := strings.TrimPrefix(name, cacheFilePrefix)
+		existing = append(existing, found{&cachedArchive{key: key, path: p, size: info.Size()}, info.ModTime()})
+	}
+	slices.SortFunc(existing, func(a, b found) int { return a.modTime.Compare(b.modTime) })
+	for _, f := range existing {
+		c.entries[f.entry.key] = c.lru.PushFront(f.entry)
+		c.total += f.entry.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c
+}
+
+// archiveKey names an archive by everything that changes its bytes. ext
+// is kept at the end so cached files have the right extension.
+func archiveKey(spec archiveSpec, ext string, include, exclude []string, size archiveSize) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00", ext, spec.level, spec.symlinks, spec.hide.fingerprint())
+	for _, src := range spec.sources {
+		fmt.Fprintf(h, "src\x00%s\x00%s\x00", src.path, src.name)
+	}
+	fmt.Fprintf(h, "include\x00%s\x00exclude\x00%s\x00", strings.Join(include, ","), strings.Join(exclude, ","))
+	fmt.Fprintf(h, "%d\x00%d\x00%d", size.Files, size.Bytes, size.modified.UnixNano())
+	return hex.EncodeToString(h.Sum(nil))[:32] + ext
+}
+
+// has reports whether the archive for key is in the cache.
+func (c *archiveCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// get returns the cached archive for key, building it with write when
+// there is none yet. An archive that grows past the whole cache is
+// abandoned with errCacheTooSmall.
+func (c *archiveCache) get(key string, write func(w io.Writer) ([]skippedEntry, error)) (*cachedArchive, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		entry := el.Value.(*cachedArchive)
+		if _, err := os.Stat(entry.path); err == nil {
+			return entry, nil
+		}
+		c.mu.Lock()
+		if c.entries[key] == el {
+			c.remove(el) // deleted behind our back, build it again
+		}
+	}
+	if b, ok := c.building[key]; ok {
+		c.mu.Unlock()
+		<-b.done
+		if b.err != nil {
+			return nil, b.err
+		}
+		return c.get(key, write)
+	}
+	b := &archiveBuild{done: make(chan struct{})}
+	c.building[key] = b
+	c.mu.Unlock()
+
+	b.entry, b.err = c.build(key, write)
+
+	c.mu.Lock()
+	delete(c.building, key)
+	if b.err == nil {
+		c.entries[key] = c.lru.PushFront(b.entry)
+		c.total += b.entry.size
+		c.evict()
+	}
+	c.mu.Unlock()
+	close(b.done)
+	return b.entry, b.err
+}
+
+// build writes an archive to a temp file and renames it into place, so a
+// half-written archive is never served. The temp file never grows past
+// maxBytes.
+func (c *archiveCache) build(key string, write func(w io.Writer) ([]skippedEntry, error)) (*cachedArchive, error) {
+	tmp, err := os.CreateTemp(c.dir, cacheFilePrefix+"*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	skipped, err := write(&cappedWriter{w: tmp, left: c.maxBytes})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	dst := filepath.Join(c.dir, cacheFilePrefix+key)
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &cachedArchive{key: key, path: dst, size: info.Size(), skipped: skipped}, nil
+}
+
+// cappedWriter fails with errCacheTooSmall instead of writing past left
+// bytes.
+type cappedWriter struct {
+	w    io.Writer
+	left int64
+}
+
+func (cw *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > cw.left {
+		return 0, errCacheTooSmall
+	}
+	n, err := cw.w.Write(p)
+	cw.left -= int64(n)
+	return n, err
+}
+
+// evict removes least recently used archives until the cache fits in
+// maxBytes. c.mu must be held.
+func (c *archiveCache) evict() {
+	for c.total > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *archiveCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedArchive)
+	delete(c.entries, entry.key)
+	c.total -= entry.size
+	// A download still reading the file keeps it on Unix; elsewhere the
+	// removal fails and the next run's index picks it up again.
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("archive cache: %v", err)
+	}
+}
+
+// serveCachedArchive builds the archive into cache unless it is there
+// already, then serves it like a static file. release frees the job slot
+// once the archive is built, since sending it is only I/O. It returns
+// false, with nothing written and the slot still held, when the archive
+// does not fit in the cache, so the caller can stream it instead.
+func serveCachedArchive(w http.ResponseWriter, r *http.Request, cache *archiveCache, key string,
+	format archiveFormat, spec archiveSpec, modified time.Time, release func()) bool {
+	entry, err := cache.get(key, func(w io.Writer) ([]skippedEntry, error) {
+		return format.write(w, spec)
+	})
+	if errors.Is(err, errCacheTooSmall) {
+		return false
+	}
+	release()
+	if err != nil {
+		log.Printf("archive cache: building %s: %v", r.URL.Path, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return true
+	}
+
+	f, err := os.Open(entry.path)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return true
+	}
+	defer f.Close()
+
+	logSkipped(w, r, entry.skipped)
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(key, format.ext)+`"`)
+	http.ServeContent(w, r, "", modified, f)
+	return true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZipHandlerCache(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte(strings.Repeat("hello ", 100)), 0644)
+
+	handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow, CacheDir: cacheDir, CacheBytes: 1 << 20}, nil)
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/__zip?path=/docs", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get(nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Content-Length") == "" || first.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("cached archive should have ETag, Content-Length and Accept-Ranges, got %v", first.Header())
+	}
+	full := first.Body.Bytes()
+	if names := zipNames(t, full); len(names) != 1 || names[0] != "a.txt" {
+		t.Errorf("unexpected entries %v", names)
+	}
+
+	resumed := get(http.Header{"Range": {"bytes=10-"}, "If-Range": {etag}})
+	if resumed.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", resumed.Code)
+	}
+	if resumed.Body.String() != string(full[10:]) {
+		t.Error("resumed body should be the rest of the same archive")
+	}
+
+	if rec := get(http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", rec.Code)
+	}
+
+	files, _ := os.ReadDir(cacheDir)
+	if len(files) != 1 {
+		t.Errorf("expected one cached archive, got %d", len(files))
+	}
+
+	later := time.Now().Add(time.Hour)
+	_ = os.Chtimes(filepath.Join(dir, "docs", "a.txt"), later, later)
+	if changed := get(nil); changed.Header().Get("ETag") == etag {
+		t.Error("changing a file should build a new archive")
+	}
+}
+
+func TestArchiveCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache := newArchiveCache(dir, 10)
+
+	builds := 0
+	write := func(content string) func(w io.Writer) ([]skippedEntry, error) {
+		return func(w io.Writer) ([]skippedEntry, error) {
+			builds++
+			_, err := io.WriteString(w, content)
+			return nil, err
+		}
+	}
+
+	a, err := cache.get("a.zip", write("aaaaaa"))
+	if err != nil {
+		t.Fatalf("get a: %v", err)
+	}
+	if _, err := cache.get("a.zip", write("aaaaaa")); err != nil || builds != 1 {
+		t.Fatalf("second get should be a hit, builds=%d err=%v", builds, err)
+	}
+	if _, err := cache.get("b.zip", write("bbbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a.path); !os.IsNotExist(err) {
+		t.Error("least recently used archive should be evicted over the size cap")
+	}
+	if cache.total != 6 {
+		t.Errorf("total = %d, want 6", cache.total)
+	}
+
+	if _, err := cache.get("big.zip", write(strings.Repeat("x", 20))); err != errCacheTooSmall {
+		t.Errorf("an archive larger than the cache: err = %v, want errCacheTooSmall", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 || cache.total != 6 {
+		t.Errorf("an abandoned build should leave only b behind, got %d files, total %d", len(files), cache.total)
+	}
+}
+
+func TestZipHandlerCacheLimits(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte(strings.Repeat("hello ", 100)), 0644)
+
+	t.Run("larger than the cache", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		// The content fits but the stored archive, with its headers, does not.
+		handler := zipHandler(dir, &ZipConfig{Level: 0, Symlinks: symlinkFollow, CacheDir: cacheDir, CacheBytes: 610}, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?path=/docs", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+			t.Fatalf("expected a streamed 200 without ETag, got %d %v", rec.Code, rec.Header())
+		}
+		if names := zipNames(t, rec.Body.Bytes()); len(names) != 1 || names[0] != "a.txt" {
+			t.Errorf("unexpected entries %v", names)
+		}
+		if files, _ := os.ReadDir(cacheDir); len(files) != 0 {
+			t.Errorf("expected an empty cache, got %d files", len(files))
+		}
+	})
+
+	t.Run("Range only resumes cached archives for free", func(t *testing.T) {
+		handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow, CacheDir: t.TempDir(), CacheBytes: 1 << 20, RatePerMinute: 1}, nil)
+		get := func(header http.Header) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/__zip?path=/docs", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+
+		first := get(http.Header{"Range": {"bytes=10-"}, "If-Range": {`"0123456789abcdef0123456789abcdef"`}})
+		if first.Code != http.StatusOK {
+			t.Fatalf("expected a full 200 for an unknown If-Range, got %d", first.Code)
+		}
+		etag := first.Header().Get("ETag")
+		if rec := get(http.Header{"Range": {"bytes=10-"}}); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("Range without If-Range: expected 429, got %d", rec.Code)
+		}
+		if rec := get(http.Header{"Range": {"bytes=10-"}, "If-Range": {etag}}); rec.Code != http.StatusPartialContent {
+			t.Errorf("resuming the cached archive: expected 206, got %d", rec.Code)
+		}
+
+		later := time.Now().Add(time.Hour)
+		_ = os.Chtimes(filepath.Join(dir, "docs", "a.txt"), later, later)
+		if rec := get(http.Header{"Range": {"bytes=10-"}, "If-Range": {etag}}); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("an If-Range for an outdated archive should be charged, got %d", rec.Code)
+		}
+	})
+}
+
+func TestArchiveCacheReindex(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{
+		cacheFilePrefix + "old.zip":  "123456",
+		cacheFilePrefix + "new.zip":  "123456",
+		cacheFilePrefix + "1234.tmp": "partial",
+		"unrelated.txt":              "keep me",
+	} {
+		_ = os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	_ = os.Chtimes(filepath.Join(dir, cacheFilePrefix+"old.zip"), old, old)
+
+	cache := newArchiveCache(dir, 10)
+
+	if _, ok := cache.entries["new.zip"]; !ok {
+		t.Error("archives from an earlier run should be reused")
+	}
+	for name, want := range map[string]bool{
+		cacheFilePrefix + "old.zip":  false, // oldest, evicted to fit
+		cacheFilePrefix + "new.zip":  true,
+		cacheFilePrefix + "1234.tmp": false,
+		"unrelated.txt":              true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Guardrails for archive downloads: a cap on concurrent jobs, per-archive
+// size and file count limits checked before streaming starts, and a
+// per-client rate limit.
+
+// archiveQueueWait is how long a download waits for a free job slot
+// before giving up with 503.
+const archiveQueueWait = 30 * time.Second
+
+// archiveIdleTimeout is how long a streamed archive waits for a stalled
+// client to accept more data before it is abandoned, freeing its slot.
+var archiveIdleTimeout = 30 * time.Second
+
+var errArchiveTooLarge = errors.New("archive too large")
+
+// archiveLimiter is shared by all requests to one zipHandler.
+type archiveLimiter struct {
+	cfg  *ZipConfig
+	jobs chan struct{} // semaphore, nil = unlimited
+
+	mu      sync.Mutex
+	clients map[string]*rateBucket
+}
+
+// rateBucket is a token bucket holding up to ZipConfig.RatePerMinute
+// downloads, refilled continuously.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newArchiveLimiter(cfg *ZipConfig) *archiveLimiter {
+	l := &archiveLimiter{cfg: cfg, clients: map[string]*rateBucket{}}
+	if cfg.MaxJobs > 0 {
+		l.jobs = make(chan struct{}, cfg.MaxJobs)
+	}
+	return l
+}
+
+// allow takes one download from client's rate budget. When the budget is
+// spent it returns false and how long until the next download is allowed.
+func (l *archiveLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rate := float64(l.cfg.RatePerMinute)
+	if rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &rateBucket{tokens: rate, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = min(rate, b.tokens+now.Sub(b.last).Minutes()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Minute))
+	}
+	b.tokens--
+
+	// Forget clients whose budget has refilled, so the map stays small.
+	for c, cb := range l.clients {
+		if cb.tokens+now.Sub(cb.last).Minutes()*rate >= rate {
+			delete(l.clients, c)
+		}
+	}
+	return true, 0
+}
+
+// acquire waits for a job slot until ctx is done or archiveQueueWait
+// passes. A true result must be paired with release.
+func (l *archiveLimiter) acquire(ctx context.Context) bool {
+	if l.jobs == nil {
+		return true
+	}
+	timer := time.NewTimer(archiveQueueWait)
+	defer timer.Stop()
+	select {
+	case l.jobs <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *archiveLimiter) release() {
+	if l.jobs != nil {
+		<-l.jobs
+	}
+}
+
+// idleWriter pushes the connection's write deadline forward before every
+// write, so a download that keeps moving is never cut off, however large,
+// while one that stalls fails after timeout.
+type idleWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	_ = iw.rc.SetWriteDeadline(time.Now().Add(iw.timeout))
+	return iw.w.Write(p)
+}
+
+// archiveClient identifies a client for rate limiting: the authenticated
+// identity, else the remote IP.
+func archiveClient(r *http.Request) string {
+	if id := requestIdentity(r); id != "" {
+		return "user:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// archiveSize is what an archive would hold before compression, as
+// returned by /__zip?estimate=1.
+type archiveSize struct {
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	MaxFiles int   `json:"maxFiles,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	TooLarge bool  `json:"tooLarge"`
+
+	modified time.Time // newest mtime of any entry, for archiveKey
+}
+
+// measureArchive walks spec without reading any file, stopping as soon
+// as it passes cfg.MaxFiles or cfg.MaxBytes. Directory mtimes count
+// toward modified, so deleting or renaming a file changes it too.
+func measureArchive(spec archiveSpec, cfg *ZipConfig) (archiveSize, error) {
+	size := archiveSize{MaxFiles: cfg.MaxFiles, MaxBytes: cfg.MaxBytes}
+	_, err := walkArchive(spec, func(e archiveEntry) error {
+		if e.info.ModTime().After(size.modified) {
+			size.modified = e.info.ModTime()
+		}
+		if e.info.IsDir() {
+			return nil
+		}
+		size.Files++
+		if e.link == "" {
+			size.Bytes += e.info.Size()
+		}
+		if cfg.MaxFiles > 0 && size.Files > cfg.MaxFiles || cfg.MaxBytes > 0 && size.Bytes > cfg.MaxBytes {
+			size.TooLarge = true
+			return errArchiveTooLarge
+		}
+		return nil
+	})
+	if err == errArchiveTooLarge {
+		err = nil
+	}
+	return size, err
+}
+
+// limitError describes why size is over the configured limits.
+func (size archiveSize) limitError() *archiveError {
+	msg := "archive too large"
+	if size.MaxFiles > 0 && size.Files > size.MaxFiles {
+		msg = "archive has more than " + strconv.Itoa(size.MaxFiles) + " files"
+	} else if size.MaxBytes > 0 {
+		msg = fmt.Sprintf("archive is larger than %d bytes", size.MaxBytes)
+	}
+	return &archiveError{http.StatusRequestEntityTooLarge, msg}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveLimiterRate(t *testing.T) {
+	l := newArchiveLimiter(&ZipConfig{RatePerMinute: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("alice", now); !ok {
+			t.Fatalf("download %d should be allowed", i+1)
+		}
+	}
+	ok, wait := l.allow("alice", now)
+	if ok {
+		t.Fatal("third download within a minute should be refused")
+	}
+	if wait <= 0 || wait > 30*time.Second {
+		t.Errorf("wait = %v, want up to 30s", wait)
+	}
+	if ok, _ := l.allow("bob", now); !ok {
+		t.Error("other clients have their own budget")
+	}
+	if ok, _ := l.allow("alice", now.Add(30*time.Second)); !ok {
+		t.Error("budget should refill over time")
+	}
+
+	unlimited := newArchiveLimiter(&ZipConfig{})
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.allow("alice", now); !ok {
+			t.Fatal("no rate limit by default")
+		}
+	}
+}
+
+func TestArchiveLimiterJobs(t *testing.T) {
+	l := newArchiveLimiter(&ZipConfig{MaxJobs: 1})
+	if !l.acquire(context.Background()) {
+		t.Fatal("first job should get a slot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if l.acquire(ctx) {
+		t.Fatal("second job should wait for the slot")
+	}
+
+	l.release()
+	if !l.acquire(context.Background()) {
+		t.Fatal("released slot should be free again")
+	}
+	l.release()
+}
+
+func TestZipHandlerLimits(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_ = os.WriteFile(filepath.Join(dir, "docs", name), []byte(strings.Repeat("x", 100)), 0644)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        ZipConfig
+		wantStatus int
+	}{
+		{"no limits", ZipConfig{}, http.StatusOK},
+		{"within limits", ZipConfig{MaxFiles: 3, MaxBytes: 300}, http.StatusOK},
+		{"too many files", ZipConfig{MaxFiles: 2}, http.StatusRequestEntityTooLarge},
+		{"too many bytes", ZipConfig{MaxBytes: 299}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Level, cfg.Symlinks = -1, symlinkFollow
+			handler := zipHandler(dir, &cfg, nil)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?path=/docs", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if rec.Code != http.StatusOK && rec.Header().Get("Content-Disposition") != "" {
+				t.Error("a refused archive should not start a download")
+			}
+		})
+	}
+}
+
+func TestZipHandlerEstimate(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("12345"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "docs", "b.log"), []byte("1234567890"), 0644)
+
+	handler := zipHandler(dir, &ZipConfig{Level: -1, Symlinks: symlinkFollow, MaxBytes: 12, RatePerMinute: 2}, nil)
+
+	tests := []struct {
+		query string
+		want  archiveSize
+	}{
+		{"path=/docs&estimate=1", archiveSize{Files: 2, Bytes: 15, MaxBytes: 12, TooLarge: true}},
+		{"path=/docs&estimate=1&exclude=*.log", archiveSize{Files: 1, Bytes: 5, MaxBytes: 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var got archiveSize
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("estimate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Estimates have a budget of their own, so checking first does not
+	// use up downloads.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?path=/docs&estimate=1", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("third estimate: expected 429, got %d", rec.Code)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/__zip?path=/docs&exclude=*.log", nil))
+		if rec.Code != want {
+			t.Fatalf("download %d: expected %d, got %d", i+1, want, rec.Code)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("expected Retry-After on 429")
+		}
+	}
+}
+
+func TestZipHandlerStalledClient(t *testing.T) {
+	root := t.TempDir()
+	_ = os.Mkdir(filepath.Join(root, "docs"), 0755)
+	// Large enough to fill the socket buffers of a client that stops reading.
+	_ = os.WriteFile(filepath.Join(root, "docs", "big.bin"), nil, 0644)
+	_ = os.Truncate(filepath.Join(root, "docs", "big.bin"), 64<<20)
+
+	saved := archiveIdleTimeout
+	archiveIdleTimeout = 200 * time.Millisecond
+	defer func() { archiveIdleTimeout = saved }()
+
+	srv := httptest.NewServer(zipHandler(root, &ZipConfig{Level: 0, Symlinks: symlinkFollow, MaxJobs: 1}, nil))
+	defer srv.Close()
+
+	stalled, err := http.Get(srv.URL + "/__zip?path=/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/__zip?path=/docs&estimate=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("the stalled download kept the job slot: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 once the stalled download was dropped, got %d", resp.StatusCode)
+	}
+}